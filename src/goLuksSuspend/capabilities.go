@@ -0,0 +1,92 @@
+package goLuksSuspend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Capabilities describe what a build of the initramfs program supports.
+// They are printed as JSON by the -capabilities flag so that go-luks-suspend
+// can work with any initramfs program that speaks the same protocol, rather
+// than only the exact same release.
+type Capabilities struct {
+	Version string `json:"version"`
+	// WireVersion of the handoff the program accepts
+	Protocol  int      `json:"protocol"`
+	Unlockers []string `json:"unlockers"`
+	Formats   []string `json:"formats"`
+	// Whether the program reports events on fd 4
+	Events bool `json:"events"`
+}
+
+// LocalCapabilities returns the capabilities of this build.
+func LocalCapabilities() Capabilities {
+	return Capabilities{
+		Version:   Version,
+		Protocol:  WireVersion,
+		Unlockers: UnlockerNames(),
+		Formats:   []string{LUKS1.String(), LUKS2.String()},
+		Events:    true,
+	}
+}
+
+func printCapabilities(w io.Writer) error {
+	return json.NewEncoder(w).Encode(LocalCapabilities())
+}
+
+func ParseCapabilities(buf []byte) (Capabilities, error) {
+	var c Capabilities
+	err := json.Unmarshal(buf, &c)
+	return c, err
+}
+
+func contains(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate checks that cryptdevs can be handed to a program with
+// capabilities c. Unlockers that c lacks are removed from the devices
+// that request them, and a warning is returned for each. An error is
+// returned if the program cannot handle cryptdevs at all.
+func (c *Capabilities) Negotiate(cryptdevs []Cryptdevice) (warnings []string, err error) {
+	if c.Protocol != WireVersion {
+		return nil, fmt.Errorf(
+			"initramfs suspend program %s speaks protocol %d, but go-luks-suspend %s speaks protocol %d; "+
+				"rebuild the initramfs and reboot",
+			c.Version, c.Protocol, Version, WireVersion,
+		)
+	}
+
+	for i := range cryptdevs {
+		cd := &cryptdevs[i]
+
+		if !contains(c.Formats, cd.Format.String()) {
+			return nil, fmt.Errorf(
+				"initramfs suspend program %s cannot suspend %s cryptdevice %s (supported formats: %s)",
+				c.Version, cd.Format, cd.Name, strings.Join(c.Formats, ", "),
+			)
+		}
+
+		names := make([]string, 0, len(cd.UnlockWith))
+		for _, name := range cd.UnlockWith {
+			if contains(c.Unlockers, name) {
+				names = append(names, name)
+			} else {
+				warnings = append(warnings, fmt.Sprintf(
+					"initramfs suspend program %s does not support the %s unlocker; not using it for %s",
+					c.Version, name, cd.Name,
+				))
+			}
+		}
+		cd.UnlockWith = names
+	}
+
+	return warnings, nil
+}
@@ -0,0 +1,49 @@
+package goLuksSuspend
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCapabilitiesNegotiation(t *testing.T) {
+	buf := bytes.Buffer{}
+	if err := printCapabilities(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := ParseCapabilities(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(local, LocalCapabilities()) {
+		t.Errorf("%#v != %#v", local, LocalCapabilities())
+	}
+
+	cryptdevs := []Cryptdevice{
+		{Name: "cryptroot", Format: LUKS2, UnlockWith: []string{"yubikey", "passphrase"}},
+	}
+
+	if warnings, err := local.Negotiate(cryptdevs); err != nil || len(warnings) > 0 {
+		t.Errorf("unexpected result: %#v, %#v", warnings, err)
+	}
+
+	old := Capabilities{Protocol: WireVersion, Unlockers: []string{"keyfile", "passphrase"}, Formats: []string{"luks1", "luks2"}}
+	warnings, err := old.Negotiate(cryptdevs)
+	if err != nil || len(warnings) != 1 {
+		t.Errorf("unexpected result: %#v, %#v", warnings, err)
+	}
+	if !reflect.DeepEqual(cryptdevs[0].UnlockWith, []string{"passphrase"}) {
+		t.Errorf("%#v != %#v", cryptdevs[0].UnlockWith, []string{"passphrase"})
+	}
+
+	old.Formats = []string{"luks1"}
+	if _, err := old.Negotiate(cryptdevs); err == nil {
+		t.Errorf("expected error for unsupported format")
+	}
+
+	old.Protocol = WireVersion + 1
+	if _, err := old.Negotiate(cryptdevs); err == nil {
+		t.Errorf("expected error for protocol mismatch")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	g "goLuksSuspend"
+)
+
+//
+// go-luks-suspend check [-json]
+//
+// Validates the suspend path without suspending anything.
+//
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "pass"
+	checkWarn checkStatus = "warn"
+	checkFail checkStatus = "fail"
+)
+
+type checkResult struct {
+	Name    string      `json:"name"`
+	Status  checkStatus `json:"status"`
+	Message string      `json:"message,omitempty"`
+}
+
+type checkReport struct {
+	Status  checkStatus   `json:"status"`
+	Results []checkResult `json:"results"`
+}
+
+func (r *checkReport) add(name string, status checkStatus, format string, args ...interface{}) {
+	r.Results = append(r.Results, checkResult{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+
+	if status == checkFail || (status == checkWarn && r.Status == checkPass) {
+		r.Status = status
+	}
+}
+
+// addError records err as a failure, or a pass with message if err is nil.
+func (r *checkReport) addError(name string, err error, message string) bool {
+	if err != nil {
+		r.add(name, checkFail, "%s", err.Error())
+		return false
+	}
+	r.add(name, checkPass, "%s", message)
+	return true
+}
+
+func (r *checkReport) print(asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	for _, res := range r.Results {
+		fmt.Printf("[%s] %s: %s\n", strings.ToUpper(string(res.Status)), res.Name, res.Message)
+	}
+	fmt.Printf("\nResult: %s\n", strings.ToUpper(string(r.Status)))
+
+	return nil
+}
+
+// runCheck implements the check command, and returns the exit status.
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	jsonFlag := flags.Bool("json", false, "print the report as JSON")
+	_ = flags.Parse(args) // errcheck: flag.ExitOnError
+
+	r := checkReport{Status: checkPass}
+	checkSuspendPath(&r)
+
+	if err := r.print(*jsonFlag); err != nil {
+		g.Warn(err.Error())
+		return 1
+	}
+
+	if r.Status == checkFail {
+		return 1
+	}
+	return 0
+}
+
+func checkSuspendPath(r *checkReport) {
+	conf, err := g.LoadConfig()
+	if !r.addError("config", err, "configuration is valid") {
+		return
+	}
+	g.SetConfig(conf)
+
+	caps, ok := checkInitramfs(r)
+
+	names, err := g.BootDeviceNames()
+	r.addError("kernel-cmdline", err, "boot cryptdevices: "+strings.Join(names, ", "))
+
+	cryptdevs, cdmap, err := g.GetCryptdevices()
+	if err == nil && len(cryptdevs) == 0 {
+		r.add("cryptdevices", checkWarn, "no active cryptdevices; suspend will not lock anything")
+		return
+	} else if !r.addError("cryptdevices", err, fmt.Sprintf("%d active cryptdevices", len(cryptdevs))) {
+		return
+	}
+
+	r.addError("crypttab", g.AddCrypttabOptions(cryptdevs, cdmap), "/etc/crypttab options are valid")
+
+	if ok {
+		warnings, err := caps.Negotiate(cryptdevs)
+		r.addError("compatibility", err, "initramfs suspend program supports every cryptdevice")
+		for _, w := range warnings {
+			r.add("compatibility", checkWarn, "%s", w)
+		}
+	}
+
+	if err := g.AddKeyfilesFromCrypttab(cdmap); os.IsNotExist(err) {
+		r.add("keyfiles", checkWarn, "/etc/crypttab does not exist")
+	} else {
+		r.addError("keyfiles", err, "/etc/crypttab keyfiles are valid")
+	}
+
+	for i := range cryptdevs {
+		checkCryptdevice(r, &cryptdevs[i])
+	}
+
+	checkStorage(r, cryptdevs)
+}
+
+// checkStorage reports what the policies of cryptdevs will do, and lists
+// the filesystems and swap areas that suspending will lock.
+func checkStorage(r *checkReport, cryptdevs []g.Cryptdevice) {
+	deps, err := g.ResolveDependents(cryptdevs)
+	if err != nil {
+		r.add("storage", checkFail, "%s", err.Error())
+		return
+	}
+
+	suspend, closures, warnings, err := g.PlanDevicePolicies(cryptdevs, deps)
+	if err != nil {
+		r.add("policies", checkFail, "%s", err.Error())
+		return
+	}
+	for _, w := range warnings {
+		r.add("policies", checkWarn, "%s", w)
+	}
+
+	released := map[string]bool{}
+	for _, c := range closures {
+		r.add("policies", checkPass, "%s will be closed", c.Name)
+		for _, d := range c.Release {
+			released[d.Path] = true
+			r.add("policies", checkPass, "%s %s will be released before closing %s", d.Kind, d.Path, c.Name)
+		}
+	}
+	for i := range cryptdevs {
+		if cryptdevs[i].Policy == g.DevicePolicyIgnore {
+			r.add("policies", checkWarn, "%s will remain unlocked while suspended", cryptdevs[i].Name)
+		}
+	}
+
+	suspended := map[string]bool{}
+	for i := range suspend {
+		suspended[suspend[i].Name] = true
+	}
+
+	hibernate := false
+	for _, p := range []g.Phase{g.PhaseSleep, g.PhaseUnlock} {
+		hibernate = hibernate || g.Conf.FailureAction(p) == g.ActionHibernate
+	}
+
+	for _, d := range deps {
+		if released[d.Path] {
+			continue
+		}
+		names := []string{}
+		for _, name := range d.Cryptdevices {
+			if suspended[name] {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		r.add("storage", checkPass, "%s %s (%s) will be locked with %s", d.Kind, d.Path, d.Type, strings.Join(names, ", "))
+		if d.Kind == g.DependentSwap && hibernate {
+			r.add("storage", checkWarn, "hibernating on failure needs swap area %s, which will be locked", d.Path)
+		}
+	}
+}
+
+// checkInitramfs inspects /run/initramfs, and returns the capabilities of
+// the suspend program if it can be run.
+func checkInitramfs(r *checkReport) (g.Capabilities, bool) {
+	if _, err := os.Stat(filepath.Join(initramfsDir, "shutdown")); err != nil {
+		r.add("initramfs", checkFail, "%s is not populated; is the shutdown hook enabled in /etc/mkinitcpio.conf?", initramfsDir)
+		return g.Capabilities{}, false
+	}
+
+	path := filepath.Join(initramfsDir, "suspend")
+
+	if err := checkRootOwnedAndExecutablePath(path); err != nil {
+		r.add("initramfs-binary", checkFail, "%s; is the suspend hook enabled in /etc/mkinitcpio.conf?", err.Error())
+		return g.Capabilities{}, false
+	}
+
+	if err := compareDigests(path, installedInitramfsBinary); err != nil {
+		r.add("initramfs-binary", checkFail, "%s; run `install -m755 %s %s`", err.Error(), installedInitramfsBinary, path)
+		return g.Capabilities{}, false
+	}
+	r.add("initramfs-binary", checkPass, "%s matches %s", path, installedInitramfsBinary)
+
+	caps, err := initramfsCapabilities(path)
+	if !r.addError("initramfs-capabilities", err, fmt.Sprintf("version %s, protocol %d", caps.Version, caps.Protocol)) {
+		return caps, false
+	}
+
+	cryptsetup := filepath.Join(initramfsDir, g.Conf.Cryptsetup)
+	if _, err := os.Stat(cryptsetup); err != nil {
+		r.add("initramfs-cryptsetup", checkFail, "%s is missing; is the encrypt or sd-encrypt hook enabled?", cryptsetup)
+	} else if err := verifyInitramfsCryptsetup(); err != nil {
+		status := checkWarn
+		if g.Conf.VerifyCryptsetup {
+			status = checkFail
+		}
+		r.add("initramfs-cryptsetup", status, "%s", err.Error())
+	} else {
+		r.add("initramfs-cryptsetup", checkPass, "%s and its libraries match the running system", cryptsetup)
+	}
+
+	return caps, true
+}
+
+func checkCryptdevice(r *checkReport, cd *g.Cryptdevice) {
+	name := "cryptdevice " + cd.Name
+	role := "unlocked after the root device"
+	if cd.IsBootDevice {
+		role = "unlocked in the initramfs"
+	}
+
+	if cd.Format != g.LUKS1 && cd.Format != g.LUKS2 {
+		r.add(name, checkFail, "unsupported format %s", cd.Format)
+		return
+	}
+
+	if len(cd.Policy) > 0 {
+		role += ", policy " + string(cd.Policy)
+	}
+
+	r.add(name, checkPass, "%s, %s", cd.Format, role)
+
+	// Closed and ignored devices are never suspended
+	resumed := cd.Policy != g.DevicePolicyUnmountAndClose && cd.Policy != g.DevicePolicyIgnore
+
+	if cd.Keyfile.Defined() && !cd.Keyfile.Available() {
+		r.add(name, checkWarn, "keyfile %s is unavailable", cd.Keyfile.Path)
+	} else if !cd.IsBootDevice && !cd.Keyfile.Defined() && resumed {
+		r.add(name, checkWarn, "no keyfile; it will remain suspended after wake")
+	}
+
+	for _, u := range cd.Unlockers() {
+		if u.Name() != "yubikey" || !cd.IsBootDevice {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(initramfsDir, g.Conf.Ykchalresp)); err != nil {
+			r.add(name, checkFail, "the yubikey unlocker needs %s in the initramfs; rebuild it with yubikey-personalization installed", g.Conf.Ykchalresp)
+		}
+	}
+}
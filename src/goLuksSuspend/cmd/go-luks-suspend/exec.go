@@ -2,13 +2,13 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -19,41 +19,46 @@ import (
 	"github.com/guns/golibs/process"
 )
 
-func checkInitramfsBinary(path string) (err error) {
-	if err = checkRootOwnedAndExecutablePath(path); err != nil {
-		return err
+// initramfsProgram returns the path of the suspend program in the
+// initramfs. When simulating, the initramfs-suspend program next to this
+// executable is run outside of the chroot instead.
+func initramfsProgram() string {
+	if g.SimulateMode {
+		if exe, err := os.Executable(); err == nil {
+			return filepath.Join(filepath.Dir(exe), "initramfs-suspend")
+		}
+		return "initramfs-suspend"
 	}
+	return filepath.Join(initramfsDir, "suspend")
+}
 
-	cmd := exec.Command(path, "-version")
-	out, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
+// initramfsCapabilities returns the capabilities of the suspend program at
+// path.
+func initramfsCapabilities(path string) (g.Capabilities, error) {
+	if g.SimulateMode {
+		g.Plan("check ownership and mode of " + path)
+	} else if err := checkRootOwnedAndExecutablePath(path); err != nil {
+		return g.Capabilities{}, err
 	}
 
-	if err = cmd.Start(); err != nil {
-		return err
-	}
-
-	defer func() { err = errutil.First(err, cmd.Wait()) }()
-
-	buf := make([]byte, 12)
-	n, err := out.Read(buf)
+	out, err := exec.Command(path, "-capabilities").Output()
 	if err != nil {
-		return err
+		version := "unknown version"
+		if v, verr := exec.Command(path, "-version").Output(); verr == nil {
+			version = string(bytes.TrimSpace(v))
+		}
+		return g.Capabilities{}, fmt.Errorf(
+			"%s (%s) predates the capability handshake of go-luks-suspend %s; rebuild the initramfs and reboot",
+			path, version, g.Version,
+		)
 	}
 
-	initramfsVersion := string(bytes.TrimSuffix(buf[:n], []byte{'\n'}))
-
-	if initramfsVersion != g.Version {
-		return fmt.Errorf(
-			"mismatched versions: go-luks-suspend %#v != %s %#v",
-			g.Version,
-			path,
-			initramfsVersion,
-		)
+	caps, err := g.ParseCapabilities(out)
+	if err != nil {
+		return caps, fmt.Errorf("%s -capabilities: %s", path, err.Error())
 	}
 
-	return nil
+	return caps, nil
 }
 
 func checkRootOwnedAndExecutablePath(path string) error {
@@ -89,28 +94,24 @@ func checkRootOwnedAndExecutable(fi os.FileInfo) error {
 
 var bindDirs = []string{"/sys", "/proc", "/dev", "/run"}
 
-func unbindInitramfs() error {
-	for _, dir := range bindDirs {
-		d := filepath.Join(initramfsDir, dir)
-		err := syscall.Unmount(d, 0)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
+// bindInitramfs bind mounts bindDirs into the initramfs, and registers
+// each mount on g.Rollback.
 func bindInitramfs() error {
 	for _, dir := range bindDirs {
-		err := syscall.Mount(dir, filepath.Join(initramfsDir, dir), "", syscall.MS_BIND, "")
+		d := filepath.Join(initramfsDir, dir)
+		err := g.Mount(dir, d, "", syscall.MS_BIND, "")
 		if err != nil {
 			return err
 		}
+		g.Rollback.Push("bind mount "+d, func() error {
+			return g.Unmount(d, 0)
+		})
 	}
 	return nil
 }
 
-const systemSleepDir = "/usr/lib/systemd/system-sleep"
+// This is a variable to facilitate testing.
+var systemSleepDir = "/usr/lib/systemd/system-sleep"
 
 // systemd-suspend.service(8):
 // Immediately before entering system suspend and/or hibernation
@@ -180,117 +181,303 @@ func startSystemServices(services []string) error {
 	return g.Systemctl(append([]string{"start"}, services...)...)
 }
 
-func disableWriteBarriers(filesystems []filesystem) error {
+// freezeFilesystems flushes and freezes filesystems in order. Filesystems
+// that do not support freezing are only flushed.
+func freezeFilesystems(filesystems []filesystem) error {
 	for i := range filesystems {
-		if err := filesystems[i].disableWriteBarrier(); err != nil {
+		err := filesystems[i].freeze()
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			g.Warn("[WARNING] " + filesystems[i].mountpoint + " cannot be frozen, only flushed")
+			continue
+		} else if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func enableWriteBarriers(filesystems []filesystem) {
-	for i := range filesystems {
+// thawFilesystems thaws the frozen filesystems in reverse order, except
+// those built upon suspended cryptdevices, whose mountpoints are returned.
+func thawFilesystems(filesystems []filesystem, cdmap map[string]*g.Cryptdevice) (frozen []string, err error) {
+	errs := []error{}
+
+	for i := len(filesystems) - 1; i >= 0; i-- {
+		fs := &filesystems[i]
+		if !fs.frozen {
+			continue
+		}
+		if fs.onSuspendedCryptdevice(cdmap) {
+			frozen = append(frozen, fs.mountpoint)
+			continue
+		}
 		// The underlying device may have disappeared
-		if !filesystems[i].isMounted() {
-			g.Warn("[WARNING] missing filesystem mounted at " + filesystems[i].mountpoint)
+		if !fs.isMounted() {
+			g.Warn("[WARNING] missing filesystem mounted at " + fs.mountpoint)
+			fs.frozen = false
 			continue
 		}
-		if err := filesystems[i].enableWriteBarrier(); err != nil {
-			g.Warn(fmt.Sprintf(
-				"[WARNING] mount %s REMOUNT BARRIER: %s",
-				filesystems[i].mountpoint,
-				err.Error(),
-			))
+		if err := fs.thaw(); err != nil {
+			errs = append(errs, err)
 		}
 	}
+
+	return frozen, errutil.Join(" • ", errs...)
 }
 
-func suspendInInitramfsChroot(cryptdevs []g.Cryptdevice) (err error) {
+// applyDevicePolicies closes the cryptdevices whose policies allow it, and
+// returns the cryptdevices to suspend. Devices with the ignore policy are
+// left unlocked. If the policies cannot be evaluated, every cryptdevice is
+// returned.
+func applyDevicePolicies(cryptdevs []g.Cryptdevice, cdmap map[string]*g.Cryptdevice) ([]g.Cryptdevice, map[string]*g.Cryptdevice, error) {
+	deps, err := g.ResolveDependents(cryptdevs)
+	if err != nil {
+		return cryptdevs, cdmap, err
+	}
+
+	suspend, closures, warnings, err := g.PlanDevicePolicies(cryptdevs, deps)
+	if err != nil {
+		return cryptdevs, cdmap, err
+	}
+	for _, w := range warnings {
+		g.Warn("[WARNING] " + w)
+	}
+
+	keep := map[string]bool{}
+	for i := range suspend {
+		keep[suspend[i].Name] = true
+	}
+	for _, name := range closeCryptdevices(closures, cdmap) {
+		keep[name] = true
+	}
+
+	remaining := make([]g.Cryptdevice, 0, len(keep))
+	for i := range cryptdevs {
+		if keep[cryptdevs[i].Name] {
+			remaining = append(remaining, cryptdevs[i])
+		} else if cryptdevs[i].Policy == g.DevicePolicyIgnore {
+			g.Debug("leaving " + cryptdevs[i].Name + " unlocked")
+		}
+	}
+
+	remainingMap := make(map[string]*g.Cryptdevice, len(remaining))
+	for i := range remaining {
+		remainingMap[remaining[i].Name] = &remaining[i]
+	}
+
+	return remaining, remainingMap, nil
+}
+
+// closeCryptdevices releases the filesystems and swap areas of each
+// closure, and closes its cryptdevice. The names of the cryptdevices that
+// could not be closed are returned, so that they can be suspended instead.
+// Filesystems and swap areas released before a failure are not restored,
+// but are reported.
+func closeCryptdevices(closures []g.Closure, cdmap map[string]*g.Cryptdevice) (open []string) {
+	for _, c := range closures {
+		g.Debug("closing " + c.Name)
+
+		var err error
+		released := []string{}
+		for _, d := range c.Release {
+			if d.Kind == g.DependentSwap {
+				err = g.Swapoff(d.Path)
+			} else {
+				err = g.Unmount(d.Path, 0)
+			}
+			if err != nil {
+				break
+			}
+			released = append(released, d.Path)
+		}
+
+		if err == nil {
+			err = cdmap[c.Name].Close()
+		}
+
+		if err != nil {
+			g.Warn(fmt.Sprintf("[WARNING] cannot close %s: %s; suspending it instead", c.Name, err.Error()))
+			if len(released) > 0 {
+				g.Warn(fmt.Sprintf("[WARNING] %s on %s remain unmounted or disabled", strings.Join(released, ", "), c.Name))
+			}
+			open = append(open, c.Name)
+		}
+	}
+
+	return open
+}
+
+// loadBootKeyfiles reads the keyfiles of boot devices that live on the
+// running system, which is not visible from the initramfs chroot. The
+// keyfiles may be on cryptdevices that are suspended before the boot
+// devices, so the returned copy of cryptdevs carries their contents.
+func loadBootKeyfiles(cryptdevs []g.Cryptdevice) ([]g.Cryptdevice, error) {
+	devs := make([]g.Cryptdevice, len(cryptdevs))
+	copy(devs, cryptdevs)
+
+	for i := range devs {
+		key := &devs[i].Keyfile
+		if !devs[i].IsBootDevice || !key.Defined() || len(key.Device) > 0 ||
+			!filepath.IsAbs(key.Path) || strings.HasPrefix(key.Path, "/dev/") {
+			continue
+		}
+
+		// Keyfiles that also exist in the initramfs are left alone
+		if _, err := os.Stat(filepath.Join(initramfsDir, key.Path)); err == nil {
+			continue
+		}
+
+		if err := key.Load(); err != nil {
+			forgetKeyfiles(devs)
+			return nil, err
+		}
+	}
+
+	return devs, nil
+}
+
+func forgetKeyfiles(cryptdevs []g.Cryptdevice) {
+	for i := range cryptdevs {
+		cryptdevs[i].Keyfile.Forget()
+	}
+}
+
+// suspendInInitramfsChroot runs the suspend program in the initramfs, and
+// returns the events it reported.
+func suspendInInitramfsChroot(cryptdevs []g.Cryptdevice) (events []g.Event, err error) {
+	// The child receives the read end of the pipe as fd 3 and the write
+	// end of the event pipe as fd 4
+	if !g.SimulateMode {
+		if cryptdevs, err = loadBootKeyfiles(cryptdevs); err != nil {
+			return nil, err
+		}
+		defer forgetKeyfiles(cryptdevs)
+	}
+
 	r, w, err := os.Pipe()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	er, ew, err := os.Pipe()
+	if err != nil {
+		return nil, errutil.First(err, r.Close(), w.Close())
 	}
 
 	args := []string{}
 	if g.DebugMode {
 		args = append(args, "-debug")
 	}
-	if g.PoweroffOnError {
+	if g.Conf.PoweroffOnError {
 		args = append(args, "-poweroff")
 	}
 
 	cmd := exec.Command("/suspend", args...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: initramfsDir}
+	if g.SimulateMode {
+		g.Plan("exec in " + initramfsDir + " chroot: /suspend " + strings.Join(args, " "))
+		cmd = exec.Command(initramfsProgram(), append(args, "-simulate", g.SimulationPath())...)
+	}
 	cmd.Dir = "/"
 	cmd.Env = []string{}
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.ExtraFiles = []*os.File{r} // child receives read end only
+	cmd.ExtraFiles = []*os.File{r, ew} // child receives read end and event write end only
 
 	if err = cmd.Start(); err != nil {
-		return errutil.First(err, r.Close(), w.Close())
+		return nil, errutil.First(err, r.Close(), w.Close(), er.Close(), ew.Close())
 	}
 
+	// Events are read as they arrive so that the child never blocks on
+	// a full pipe
+	var received []g.Event
+	var eventErr error
+	done := make(chan struct{})
+
+	go func() {
+		received, eventErr = g.ReadEvents(er)
+		eventErr = errutil.First(eventErr, er.Close())
+		close(done)
+	}()
+
 	defer func() {
 		werr := w.Close()                          // close write end once here
 		err = errutil.First(err, cmd.Wait(), werr) // reap child once here
+		<-done                                     // EOF once the child has exited
+		events = received
+		if eventErr != nil {
+			g.Warn("[WARNING] reading events from initramfs: " + eventErr.Error())
+		}
 	}()
 
-	// Close our unused read end now
-	if err = r.Close(); err != nil {
-		return err
+	// Close our unused pipe ends now
+	if err = errutil.First(r.Close(), ew.Close()); err != nil {
+		return nil, err
 	}
 
-	err = gob.NewEncoder(w).Encode(cryptdevs)
+	err = g.EncodeHandoff(w, g.Conf, cryptdevs)
 	if err != nil {
 		process.Terminate(cmd.Process, 2*time.Second)
 	}
 
-	return err
+	return nil, err
 }
 
 func resumeCryptdevicesWithKeyfiles(cryptdevs []g.Cryptdevice) {
+	// Devices in one level only depend on devices in earlier levels, so
+	// each level is resumed concurrently once the previous one is done.
+	levels, err := g.ResumeLevels(cryptdevs)
+	if err != nil {
+		g.Warn("[ERROR] " + err.Error())
+		return
+	}
+
 	n := runtime.NumCPU()
-	wg := sync.WaitGroup{}
-	ch := make(chan *g.Cryptdevice)
 
-	wg.Add(1)
-	go func() {
-		for i := range cryptdevs {
-			ch <- &cryptdevs[i]
-		}
-		close(ch)
-		wg.Done()
-	}()
+	for _, level := range levels {
+		wg := sync.WaitGroup{}
+		ch := make(chan *g.Cryptdevice)
 
-	wg.Add(n)
-	for i := 0; i < n; i++ {
-		go func() {
-			for cd := range ch {
-				if !cd.Suspended() {
-					continue
-				} else if !cd.Exists() {
-					g.Warn("[WARNING] missing cryptdevice " + cd.Name)
-					continue
-				} else if !cd.Keyfile.Available() {
-					g.Warn(fmt.Sprintf("[WARNING] keyfile for cryptdevice %s unavailable; skipping", cd.Name))
-					continue
+		wg.Add(1)
+		go func(level []int) {
+			for _, i := range level {
+				ch <- &cryptdevs[i]
+			}
+			close(ch)
+			wg.Done()
+		}(level)
+
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func() {
+				for cd := range ch {
+					resumeCryptdeviceWithKeyfile(cd)
 				}
+				wg.Done()
+			}()
+		}
 
-				g.Warn("Resuming " + cd.Name)
+		wg.Wait()
+	}
+}
 
-				err := cd.ResumeWithKeyfile()
-				if err != nil {
-					g.Warn(fmt.Sprintf("[ERROR] failed to resume %s: %s", cd.Name, err.Error()))
-				} else {
-					g.Warn(cd.Name + " resumed")
-				}
-			}
-			wg.Done()
-		}()
+func resumeCryptdeviceWithKeyfile(cd *g.Cryptdevice) {
+	if !cd.Suspended() {
+		return
+	} else if !cd.Exists() {
+		g.Warn("[WARNING] missing cryptdevice " + cd.Name)
+		return
+	} else if !cd.Keyfile.Available() {
+		g.Warn(fmt.Sprintf("[WARNING] keyfile for cryptdevice %s unavailable; skipping", cd.Name))
+		return
 	}
 
-	wg.Wait()
+	g.Warn("Resuming " + cd.Name)
+
+	err := cd.ResumeWithKeyfile()
+	if err != nil {
+		g.Warn(fmt.Sprintf("[ERROR] failed to resume %s: %s", cd.Name, err.Error()))
+	} else {
+		g.Warn(cd.Name + " resumed")
+	}
 }
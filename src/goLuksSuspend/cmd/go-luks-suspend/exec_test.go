@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	g "goLuksSuspend"
+	"goLuksSuspend/internal/roottest"
+	"goLuksSuspend/internal/runnertest"
+)
+
+// checkTranscript compares the transcript of r with groups of command
+// lines. Commands within a group may run in any order.
+func checkTranscript(t *testing.T, r *runnertest.Runner, groups ...[]string) {
+	got := r.Transcript()
+
+	for _, group := range groups {
+		if len(got) < len(group) {
+			t.Errorf("transcript ended early; expected %#v", group)
+			return
+		}
+		part := append([]string(nil), got[:len(group)]...)
+		expected := append([]string(nil), group...)
+		sort.Strings(part)
+		sort.Strings(expected)
+		if !reflect.DeepEqual(part, expected) {
+			t.Errorf("%#v != %#v", part, expected)
+		}
+		got = got[len(group):]
+	}
+
+	if len(got) > 0 {
+		t.Errorf("unexpected commands: %#v", got)
+	}
+}
+
+func TestSystemServicesTranscript(t *testing.T) {
+	runnertest.With(func(r *runnertest.Runner) {
+		// syslog.socket is inactive, and stopping udevd fails
+		r.On("/usr/bin/systemctl --quiet is-active syslog.socket", runnertest.Result{Err: g.ExitStatus(3)})
+		r.On("/usr/bin/systemctl stop", runnertest.Result{Err: g.ExitStatus(1)})
+
+		services := []string{"syslog.socket", "systemd-journald.service", "systemd-udevd.service"}
+
+		stopped, err := stopSystemServices(services)
+		if err == nil {
+			t.Errorf("expected an error from systemctl stop")
+		}
+		if expected := []string{"systemd-journald.service", "systemd-udevd.service"}; !reflect.DeepEqual(stopped, expected) {
+			t.Errorf("%#v != %#v", stopped, expected)
+		}
+
+		if err := startSystemServices(stopped); err != nil {
+			t.Error(err)
+		}
+
+		checkTranscript(t, r,
+			[]string{"/usr/bin/systemctl --quiet is-active syslog.socket"},
+			[]string{"/usr/bin/systemctl --quiet is-active systemd-journald.service"},
+			[]string{"/usr/bin/systemctl --quiet is-active systemd-udevd.service"},
+			[]string{"/usr/bin/systemctl stop systemd-journald.service systemd-udevd.service"},
+			[]string{"/usr/bin/systemctl start systemd-journald.service systemd-udevd.service"},
+		)
+	})
+}
+
+func TestSystemSuspendScriptsTranscript(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("sleep scripts must be owned by root")
+	}
+
+	dir, err := ioutil.TempDir("", "go-luks-suspend-sleep")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	systemSleepDirSave := systemSleepDir
+	systemSleepDir = dir
+	defer func() {
+		_ = os.RemoveAll(dir) // errcheck: rm -rf
+		systemSleepDir = systemSleepDirSave
+	}()
+
+	scripts := map[string]os.FileMode{"a": 0755, "b": 0755, "not-executable": 0644, "world-writable": 0757}
+	for name, mode := range scripts {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runnertest.With(func(r *runnertest.Runner) {
+		r.On(filepath.Join(dir, "b")+" post", runnertest.Result{Err: g.ExitStatus(1)})
+
+		if err := runSystemSuspendScripts("pre"); err != nil {
+			t.Error(err)
+		}
+		if err := runSystemSuspendScripts("post"); err == nil {
+			t.Errorf("expected an error from %s", filepath.Join(dir, "b"))
+		}
+
+		checkTranscript(t, r,
+			[]string{filepath.Join(dir, "a") + " pre suspend", filepath.Join(dir, "b") + " pre suspend"},
+			[]string{filepath.Join(dir, "a") + " post suspend", filepath.Join(dir, "b") + " post suspend"},
+		)
+	})
+}
+
+// dmFixture returns the sysfs files of the device-mapper device dm-n.
+func dmFixture(n int, name, uuid string, slaves ...string) map[string]string {
+	dir := "sys/block/dm-" + strconv.Itoa(n)
+	files := map[string]string{
+		dir + "/dev":          "254:" + strconv.Itoa(n) + "\n",
+		dir + "/dm/name":      name + "\n",
+		dir + "/dm/uuid":      uuid + "\n",
+		dir + "/dm/suspended": "0\n",
+	}
+	for _, s := range slaves {
+		files[dir+"/slaves/"+s] = ""
+	}
+	return files
+}
+
+func TestResumeWithKeyfilesTranscript(t *testing.T) {
+	// Keyfiles are looked up within Root, but handed to cryptsetup as is
+	key := "/keyfile"
+
+	// cryptroot ─ vg-home ─ crypthome ─ cryptnested
+	// cryptdata, cryptswap, cryptlost (keyfile missing)
+	fixture := map[string]string{
+		"keyfile":      "secret",
+		"proc/cmdline": "cryptdevice=/dev/sda2:cryptroot root=/dev/mapper/cryptroot\n",
+		"etc/crypttab": "crypthome   /dev/vg/home  " + key + "\n" +
+			"cryptnested /dev/dm-2     " + key + "\n" +
+			"cryptdata   /dev/sdb      " + key + "\n" +
+			"cryptswap   /dev/sdc      " + key + "\n" +
+			"cryptlost   /dev/sdd      /nonexistent/keyfile\n",
+	}
+	layout := []map[string]string{
+		dmFixture(0, "cryptroot", "CRYPT-LUKS2-00000000000000000000000000000000-cryptroot"),
+		dmFixture(1, "vg-home", "LVM-WzUpUi7wF6eKHH5Ikbg3jz5iDgvjd4F8", "dm-0"),
+		dmFixture(2, "crypthome", "CRYPT-LUKS2-22222222222222222222222222222222-crypthome", "dm-1"),
+		dmFixture(3, "cryptnested", "CRYPT-LUKS1-33333333333333333333333333333333-cryptnested", "dm-2"),
+		dmFixture(4, "cryptdata", "CRYPT-LUKS2-44444444444444444444444444444444-cryptdata"),
+		dmFixture(5, "cryptswap", "CRYPT-LUKS2-55555555555555555555555555555555-cryptswap"),
+		dmFixture(6, "cryptlost", "CRYPT-LUKS2-66666666666666666666666666666666-cryptlost"),
+	}
+	for _, files := range layout {
+		for k, v := range files {
+			fixture[k] = v
+		}
+	}
+	defer roottest.TempRoot(t, &g.Root, fixture)()
+	dir := g.Root
+
+	if err := os.MkdirAll(filepath.Join(dir, "sys/class/block"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := range layout {
+		name := "dm-" + strconv.Itoa(i)
+		if err := os.Symlink("../../block/"+name, filepath.Join(dir, "sys/class/block", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cryptdevs, cdmap, err := g.GetCryptdevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddKeyfilesFromCrypttab(cdmap); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything but the boot device is still suspended after wake
+	for i := 2; i < len(layout); i++ {
+		roottest.WriteFiles(t, dir, map[string]string{"sys/block/dm-" + strconv.Itoa(i) + "/dm/suspended": "1\n"})
+	}
+
+	runnertest.With(func(r *runnertest.Runner) {
+		// cryptswap fails, which does not stop the rest
+		r.On("/usr/bin/cryptsetup --key-file "+key+" --type luks2 luksResume cryptswap", runnertest.Result{Err: g.ExitStatus(2)})
+
+		resumeCryptdevicesWithKeyfiles(cryptdevs)
+
+		resume := func(format, name string) string {
+			return "/usr/bin/cryptsetup --key-file " + key + " --type " + format + " luksResume " + name
+		}
+
+		checkTranscript(t, r,
+			[]string{resume("luks2", "cryptdata"), resume("luks2", "cryptswap")},
+			[]string{resume("luks2", "crypthome")},
+			[]string{resume("luks1", "cryptnested")},
+		)
+	})
+}
@@ -1,56 +1,157 @@
 package main
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"os"
-	"strings"
 	"syscall"
+
+	g "goLuksSuspend"
 )
 
+// Filesystems built upon cryptdevices are flushed in a way that suits their
+// type and frozen with FIFREEZE before the cryptdevices are suspended, so
+// that their dirty data is on disk and no further writes reach the locked
+// devices, and thawed with FITHAW once the cryptdevices have been resumed.
+
 type filesystem struct {
 	mountpoint string
+	fstype     string
 	devno      uint64
+	// Kernel names of the block device of the filesystem and of those it
+	// is built upon
+	stack []string
+	// Names of the cryptdevices the filesystem is built upon
+	cryptdevs []string
+	// Identifies the filesystem among its mounts
+	key    string
+	frozen bool
 }
 
-func getFilesystemsWithWriteBarriers() ([]filesystem, error) {
-	file, err := os.Open("/proc/mounts")
+// getFilesystemsToFreeze returns the filesystems among deps, in the order
+// in which they must be frozen. The filesystem containing this program is
+// left alone, so that it can still be loaded from.
+func getFilesystemsToFreeze(deps []g.Dependent) ([]filesystem, error) {
+	self := uint64(0)
+	exe, err := os.Executable()
 	if err != nil {
 		return nil, err
 	}
+	if !g.SimulateMode {
+		if self, err = lstatDevno(exe); err != nil {
+			return nil, err
+		}
+	}
 
 	fs := []filesystem{}
-	s := bufio.NewScanner(file)
+	seen := map[string]bool{}
+	skip := map[string]bool{}
 
-	for s.Scan() {
-		fields := strings.Fields(s.Text())
+	for _, d := range deps {
+		if d.Kind != g.DependentFilesystem {
+			continue
+		}
 
-		if len(fields) != 6 {
-			return nil, errors.New("malformed entry in /proc/mounts: " + s.Text())
+		// Simulated filesystems have no block devices
+		key := d.Path
+		if len(d.Stack) > 0 {
+			key = d.Stack[0]
 		}
 
-		if hasWriteBarrier(fields[2], fields[3]) {
-			devno, err := lstatDevno(fields[1])
-			if err != nil {
-				return nil, err
+		devno := uint64(0)
+		if !g.SimulateMode {
+			if devno, err = lstatDevno(d.Path); err != nil {
+				g.Debug("skipping " + d.Path + ": " + err.Error())
+				continue
+			}
+			if devno == self {
+				g.Debug("not freezing " + d.Path + ", which contains " + exe)
+				skip[key] = true
 			}
+		}
 
-			fs = append(fs, filesystem{
-				mountpoint: fields[1],
-				devno:      devno,
-			})
+		// A filesystem may be mounted more than once, but can only be
+		// frozen once
+		if seen[key] {
+			continue
 		}
+		seen[key] = true
+
+		fs = append(fs, filesystem{
+			mountpoint: d.Path,
+			fstype:     d.Type,
+			devno:      devno,
+			stack:      d.Stack,
+			cryptdevs:  d.Cryptdevices,
+			key:        key,
+		})
 	}
 
-	if err := file.Close(); err != nil {
-		return nil, err
+	// The filesystem containing this program may have been recorded under
+	// another mountpoint first
+	unskipped := fs[:0]
+	for i := range fs {
+		if !skip[fs[i].key] {
+			unskipped = append(unskipped, fs[i])
+		}
 	}
 
-	return fs, nil
+	return freezeOrder(unskipped)
+}
+
+// builtUpon reports whether the block device of other is beneath fs, as
+// when fs is on a loop device whose backing file is on other.
+func (fs *filesystem) builtUpon(other *filesystem) bool {
+	if len(other.stack) == 0 {
+		return false
+	}
+
+	for _, name := range fs.stack[1:] {
+		if name == other.stack[0] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// freezeOrder sorts filesystems so that each one precedes the filesystems
+// it is built upon. Freezing a filesystem first would deadlock when the
+// filesystems stacked on top of it flush their pending writes.
+func freezeOrder(filesystems []filesystem) ([]filesystem, error) {
+	ordered := make([]filesystem, 0, len(filesystems))
+	placed := make([]bool, len(filesystems))
+
+	for len(ordered) < len(filesystems) {
+		n := len(ordered)
+
+	outer:
+		for i := range filesystems {
+			if placed[i] {
+				continue
+			}
+			for j := range filesystems {
+				if !placed[j] && j != i && filesystems[j].builtUpon(&filesystems[i]) {
+					continue outer
+				}
+			}
+			placed[i] = true
+			ordered = append(ordered, filesystems[i])
+		}
+
+		if len(ordered) == n {
+			return nil, errors.New("filesystems are built upon each other in a cycle")
+		}
+	}
+
+	return ordered, nil
 }
 
 func (fs *filesystem) isMounted() bool {
+	if g.SimulateMode {
+		return true
+	}
+
 	devno, err := lstatDevno(fs.mountpoint)
 	if err != nil {
 		return false
@@ -59,29 +160,34 @@ func (fs *filesystem) isMounted() bool {
 	return fs.devno == devno
 }
 
-func (fs *filesystem) disableWriteBarrier() error {
-	return syscall.Mount("", fs.mountpoint, "", syscall.MS_REMOUNT, "nobarrier")
+// onSuspendedCryptdevice reports whether any cryptdevice fs is built upon
+// is suspended. Thawing it would hang when it writes its superblock.
+func (fs *filesystem) onSuspendedCryptdevice(cdmap map[string]*g.Cryptdevice) bool {
+	for _, name := range fs.cryptdevs {
+		if cd, ok := cdmap[name]; ok && cd.Suspended() {
+			return true
+		}
+	}
+	return false
 }
 
-func (fs *filesystem) enableWriteBarrier() error {
-	return syscall.Mount("", fs.mountpoint, "", syscall.MS_REMOUNT, "barrier")
+func (fs *filesystem) freeze() error {
+	if err := g.QuiesceFilesystem(fs.mountpoint, fs.fstype); err != nil {
+		return err
+	}
+	if err := g.FreezeFilesystem(fs.mountpoint); err != nil {
+		return err
+	}
+	fs.frozen = true
+	return nil
 }
 
-func hasWriteBarrier(fstype, mountopts string) bool {
-	switch fstype {
-	// ReiserFS supports write barriers, but the option syntax appears to
-	// be unconventional. Since it's fading into obscurity, just ignore it.
-	case "ext2", "ext3", "ext4":
-		for _, o := range strings.Split(mountopts, ",") {
-			// Write barriers are on by default and do not show up
-			// in the list of mount options, so check for the negative
-			if o == "barrier=0" || o == "nobarrier" {
-				return false
-			}
-		}
-		return true
+func (fs *filesystem) thaw() error {
+	if err := g.ThawFilesystem(fs.mountpoint); err != nil {
+		return err
 	}
-	return false
+	fs.frozen = false
+	return nil
 }
 
 func lstatDevno(path string) (uint64, error) {
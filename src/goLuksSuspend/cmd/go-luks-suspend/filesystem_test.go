@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFreezeOrder(t *testing.T) {
+	// /data is on a loop device whose backing file is on /home, and /mnt
+	// is on a loop device whose backing file is on /data
+	filesystems := []filesystem{
+		{mountpoint: "/", stack: []string{"dm-0", "sda2", "sda"}},
+		{mountpoint: "/home", stack: []string{"dm-2", "dm-1", "dm-0", "sda2", "sda"}},
+		{mountpoint: "/data", stack: []string{"dm-3", "loop0", "dm-2", "dm-1", "dm-0", "sda2", "sda"}},
+		{mountpoint: "/mnt", stack: []string{"loop1", "dm-3", "loop0", "dm-2", "dm-1", "dm-0", "sda2", "sda"}},
+		{mountpoint: "/srv", stack: []string{"dm-4", "sdb"}},
+	}
+
+	ordered, err := freezeOrder(filesystems)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for i := range ordered {
+		got = append(got, ordered[i].mountpoint)
+	}
+
+	if expected := []string{"/mnt", "/srv", "/data", "/home", "/"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("%#v != %#v", got, expected)
+	}
+
+	cycle := []filesystem{
+		{mountpoint: "/a", stack: []string{"loop0", "loop1"}},
+		{mountpoint: "/b", stack: []string{"loop1", "loop0"}},
+	}
+	if _, err := freezeOrder(cycle); err == nil {
+		t.Errorf("expected error for cycle")
+	}
+}
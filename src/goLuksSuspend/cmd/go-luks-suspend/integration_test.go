@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	g "goLuksSuspend"
+	"goLuksSuspend/internal/roottest"
+	"goLuksSuspend/internal/runnertest"
+)
+
+//
+// Integration tests
+//
+// These tests create LUKS1 and LUKS2 volumes on loop devices, and run the
+// suspend cycle against them with a minimal initramfs chroot. Suspend to
+// RAM is replaced by a FIFO over /sys/power/state, on which the test waits
+// while the system would be asleep. systemctl is faked so that the host's
+// services are left alone.
+//
+// They must be run as root, and are skipped otherwise or with -short.
+//
+
+func requireIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("integration tests must be run as root")
+	}
+	for _, prog := range []string{"cryptsetup", "dmsetup", "losetup", "mkfs.ext4", "ldd", "go"} {
+		if _, err := exec.LookPath(prog); err != nil {
+			t.Skip(prog + " is not installed")
+		}
+	}
+	if _, err := os.Stat("/dev/mapper/control"); err != nil {
+		t.Skip("device-mapper is unavailable")
+	}
+}
+
+func command(t *testing.T, name string, args ...string) string {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %s: %s\n%s", name, strings.Join(args, " "), err.Error(), out)
+	}
+	return string(bytes.TrimSpace(out))
+}
+
+// integrationRunner fakes systemctl and runs everything else.
+type integrationRunner struct {
+	runnertest.Runner
+}
+
+func (r *integrationRunner) Run(cmd *exec.Cmd) error {
+	if len(cmd.Args) > 0 && cmd.Args[0] == g.Conf.Systemctl {
+		return r.Runner.Run(cmd)
+	}
+	return g.ExecRunner{}.Run(cmd)
+}
+
+type integrationEnv struct {
+	t        *testing.T
+	dir      string
+	root     string
+	chroot   string
+	mnt      string
+	fifo     string
+	keyfile  string
+	names    []string
+	teardown []func()
+}
+
+func (e *integrationEnv) onClose(f func()) {
+	e.teardown = append(e.teardown, f)
+}
+
+func (e *integrationEnv) close() {
+	for i := len(e.teardown) - 1; i >= 0; i-- {
+		e.teardown[i]()
+	}
+}
+
+func (e *integrationEnv) loopDevice(name string, size int64) string {
+	img := filepath.Join(e.dir, name+".img")
+	f, err := os.Create(img)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		e.t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		e.t.Fatal(err)
+	}
+
+	loop := command(e.t, "losetup", "--find", "--show", img)
+	e.onClose(func() { _ = exec.Command("losetup", "--detach", loop).Run() }) // errcheck: teardown
+
+	return loop
+}
+
+func (e *integrationEnv) luksDevice(format, name string) string {
+	loop := e.loopDevice(name, 40<<20)
+	command(e.t, "cryptsetup", "luksFormat", "--batch-mode", "--type", format,
+		"--pbkdf", "pbkdf2", "--pbkdf-force-iterations", "1000", "--key-file", e.keyfile, loop)
+	command(e.t, "cryptsetup", "open", "--key-file", e.keyfile, loop, name)
+	e.names = append(e.names, name)
+	e.onClose(func() {
+		// A failed test may leave the device suspended
+		_ = exec.Command("cryptsetup", "luksResume", "--key-file", e.keyfile, name).Run() // errcheck: teardown
+		_ = exec.Command("cryptsetup", "close", name).Run()                               // errcheck: teardown
+	})
+	return loop
+}
+
+// install copies the file at path into the chroot, along with the shared
+// libraries and interpreter it needs.
+func (e *integrationEnv) install(path string) {
+	files := []string{path}
+	for _, line := range strings.Split(command(e.t, "ldd", path), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[1] == "=>" && filepath.IsAbs(fields[2]) {
+			files = append(files, fields[2])
+		} else if len(fields) >= 1 && filepath.IsAbs(fields[0]) {
+			files = append(files, fields[0])
+		}
+	}
+
+	for _, f := range files {
+		buf, err := ioutil.ReadFile(f)
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		dst := filepath.Join(e.chroot, f)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			e.t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dst, buf, 0755); err != nil {
+			e.t.Fatal(err)
+		}
+	}
+}
+
+func newIntegrationEnv(t *testing.T) (env *integrationEnv) {
+	dir, err := ioutil.TempDir("", "go-luks-suspend-integration")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &integrationEnv{
+		t:       t,
+		dir:     dir,
+		root:    filepath.Join(dir, "root"),
+		chroot:  filepath.Join(dir, "initramfs"),
+		mnt:     filepath.Join(dir, "mnt"),
+		fifo:    filepath.Join(dir, "state"),
+		keyfile: filepath.Join(dir, "keyfile"),
+	}
+	e.onClose(func() { _ = os.RemoveAll(dir) }) // errcheck: teardown
+
+	// t.Fatal returns before the caller can defer close
+	defer func() {
+		if env == nil {
+			e.close()
+		}
+	}()
+
+	// Restore the globals changed below
+	rootSave, initramfsDirSave, systemSleepDirSave := g.Root, initramfsDir, systemSleepDir
+	bindDirsSave, confSave := bindDirs, g.Conf
+	e.onClose(func() {
+		g.Root, initramfsDir, systemSleepDir = rootSave, initramfsDirSave, systemSleepDirSave
+		bindDirs, g.Conf = bindDirsSave, confSave
+	})
+
+	key := make([]byte, 64)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(e.keyfile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The boot device is unlocked by the initramfs, and the other with a
+	// keyfile from /etc/crypttab once it is done
+	tag := fmt.Sprintf("glstest%d", os.Getpid())
+	bootLoop := e.luksDevice("luks2", tag+"-root")
+	dataLoop := e.luksDevice("luks1", tag+"-data")
+
+	// A filesystem on the data device, which is frozen while suspended
+	dataDev := "/dev/mapper/" + e.names[1]
+	command(t, "mkfs.ext4", "-q", dataDev)
+	if err := os.Mkdir(e.mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount(dataDev, e.mnt, "ext4", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	e.onClose(func() { _ = syscall.Unmount(e.mnt, syscall.MNT_DETACH) }) // errcheck: teardown
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(e.mnt, &st); err != nil {
+		t.Fatal(err)
+	}
+
+	// The system root: the real sysfs and /dev, with a kernel command line,
+	// crypttab, and mount table that only refer to the devices above
+	roottest.WriteFiles(t, e.root, map[string]string{
+		"proc/cmdline":        "cryptdevice=" + bootLoop + ":" + e.names[0] + " cryptkey=rootfs:" + e.keyfile + "\n",
+		"proc/self/mountinfo": fmt.Sprintf("100 1 %s / %s rw,relatime - ext4 %s rw\n", devString(st.Dev), e.mnt, dataDev),
+		"etc/crypttab":        e.names[1] + " " + dataLoop + " " + e.keyfile + "\n",
+	})
+	for _, d := range []string{"/sys", "/dev"} {
+		if err := os.Symlink(d, filepath.Join(e.root, d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.Root = e.root
+
+	// The initramfs
+	for _, d := range []string{"sys", "proc", "dev", "run"} {
+		if err := os.MkdirAll(filepath.Join(e.chroot, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build := exec.Command("go", "build", "-o", filepath.Join(e.chroot, "suspend"), "goLuksSuspend/cmd/initramfs-suspend")
+	build.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building initramfs-suspend: %s\n%s", err.Error(), out)
+	}
+
+	cryptsetup, err := exec.LookPath("cryptsetup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.install(cryptsetup)
+	e.install("/bin/sh")
+
+	// udevd is started for boot devices with keyfiles
+	roottest.WriteFiles(t, e.chroot, map[string]string{
+		"usr/lib/systemd/systemd-udevd": "#!/bin/sh\nexit 0\n",
+		"usr/bin/udevadm":               "#!/bin/sh\nexit 0\n",
+	})
+	for _, f := range []string{"usr/lib/systemd/systemd-udevd", "usr/bin/udevadm"} {
+		if err := os.Chmod(filepath.Join(e.chroot, f), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// /sys is bound here instead of by bindInitramfs so that suspend to
+	// RAM can be replaced with a FIFO. The mount is made private so that
+	// the FIFO does not propagate to the real /sys.
+	sys := filepath.Join(e.chroot, "sys")
+	if err := syscall.Mount("/sys", sys, "", syscall.MS_BIND, ""); err != nil {
+		t.Fatal(err)
+	}
+	e.onClose(func() { _ = syscall.Unmount(sys, syscall.MNT_DETACH) }) // errcheck: teardown
+	if err := syscall.Mount("", sys, "", syscall.MS_PRIVATE, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(e.fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	state := filepath.Join(sys, "power", "state")
+	if err := syscall.Mount(e.fifo, state, "", syscall.MS_BIND, ""); err != nil {
+		t.Fatal(err)
+	}
+	e.onClose(func() { _ = syscall.Unmount(state, syscall.MNT_DETACH) }) // errcheck: teardown
+
+	initramfsDir = e.chroot
+	systemSleepDir = filepath.Join(dir, "system-sleep")
+	if err := os.Mkdir(systemSleepDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	bindDirs = []string{"/proc", "/dev", "/run"}
+
+	g.Conf = g.DefaultConfig()
+	g.Conf.Cryptsetup = cryptsetup
+	g.Conf.SystemdServices = []string{tag + ".service"}
+
+	return e
+}
+
+// cryptdevices returns the test cryptdevices, ignoring those of the host.
+func (e *integrationEnv) cryptdevices() ([]g.Cryptdevice, map[string]*g.Cryptdevice) {
+	all, _, err := g.GetCryptdevices()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	cryptdevs := []g.Cryptdevice{}
+	for i := range all {
+		for _, name := range e.names {
+			if all[i].Name == name {
+				cryptdevs = append(cryptdevs, all[i])
+			}
+		}
+	}
+	if len(cryptdevs) != len(e.names) {
+		e.t.Fatalf("expected cryptdevices %#v, found %#v", e.names, cryptdevs)
+	}
+
+	cdmap := make(map[string]*g.Cryptdevice, len(cryptdevs))
+	for i := range cryptdevs {
+		cdmap[cryptdevs[i].Name] = &cryptdevs[i]
+	}
+
+	if err := g.AddCrypttabOptions(cryptdevs, cdmap); err != nil {
+		e.t.Fatal(err)
+	}
+
+	return cryptdevs, cdmap
+}
+
+// suspend runs the suspend cycle with runner, and reports whether it failed.
+func (e *integrationEnv) suspend(runner g.Runner) (failed bool) {
+	cryptdevs, cdmap := e.cryptdevices()
+
+	prev := g.SetRunner(runner)
+	defer func() {
+		g.SetRunner(prev)
+		if r := recover(); r != nil {
+			e.t.Logf("suspend failed: %v", r)
+			failed = true
+		}
+	}()
+
+	suspend(cryptdevs, cdmap, g.LocalCapabilities())
+
+	return false
+}
+
+// cryptKey returns the key field of the dm-crypt table of name. Wiped keys
+// are all zeroes.
+func cryptKey(name string) (string, error) {
+	out, err := exec.Command("dmsetup", "table", "--showkeys", name).Output()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 5 || fields[2] != "crypt" {
+		return "", fmt.Errorf("unexpected table for %s: %#v", name, string(out))
+	}
+	return fields[4], nil
+}
+
+// mountOptions returns the options of the filesystem mounted at
+// mountpoint, if any.
+func mountOptions(mountpoint string) (opts string, ok bool) {
+	buf, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return "", false
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 6 && fields[1] == mountpoint {
+			opts, ok = fields[3], true
+		}
+	}
+
+	return opts, ok
+}
+
+// isFrozen reports whether the filesystem at mountpoint is frozen. It must
+// not be called while the device of the filesystem is suspended.
+func isFrozen(mountpoint string) (bool, error) {
+	err := g.FreezeFilesystem(mountpoint)
+	if errors.Is(err, syscall.EBUSY) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, g.ThawFilesystem(mountpoint)
+}
+
+// devString formats the device number dev as major:minor.
+func devString(dev uint64) string {
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff)
+	minor := (dev & 0xff) | ((dev >> 12) &^ 0xff)
+	return fmt.Sprintf("%d:%d", major, minor)
+}
+
+// checkRestored verifies that the system is as it was before suspending.
+func (e *integrationEnv) checkRestored(r *integrationRunner) {
+	for _, d := range []string{"proc", "dev", "run"} {
+		if _, ok := mountOptions(filepath.Join(e.chroot, d)); ok {
+			e.t.Errorf("%s is still mounted", filepath.Join(e.chroot, d))
+		}
+	}
+
+	if frozen, err := isFrozen(e.mnt); err != nil {
+		e.t.Error(err)
+	} else if frozen {
+		e.t.Errorf("%s is still frozen", e.mnt)
+	}
+
+	cryptdevs, _ := e.cryptdevices()
+	for i := range cryptdevs {
+		if cryptdevs[i].Suspended() {
+			e.t.Errorf("%s is still suspended", cryptdevs[i].Name)
+		}
+	}
+
+	stopped, started := 0, 0
+	for _, line := range r.Transcript() {
+		if strings.HasPrefix(line, g.Conf.Systemctl+" stop") {
+			stopped++
+		} else if strings.HasPrefix(line, g.Conf.Systemctl+" start") {
+			started++
+		}
+	}
+	if stopped != started {
+		e.t.Errorf("services stopped %d times but started %d times: %#v", stopped, started, r.Transcript())
+	}
+}
+
+func TestIntegration(t *testing.T) {
+	requireIntegration(t)
+
+	e := newIntegrationEnv(t)
+	defer e.close()
+
+	t.Run("services fail to stop", func(t *testing.T) {
+		e.t = t
+		r := &integrationRunner{}
+		r.On(g.Conf.Systemctl+" stop", runnertest.Result{Err: g.ExitStatus(1)})
+
+		if !e.suspend(r) {
+			t.Errorf("expected suspend to fail")
+		}
+		e.checkRestored(r)
+	})
+
+	t.Run("initramfs program fails", func(t *testing.T) {
+		e.t = t
+		r := &integrationRunner{}
+
+		// Without cryptsetup, the initramfs cannot suspend anything
+		cryptsetup := filepath.Join(e.chroot, g.Conf.Cryptsetup)
+		if err := os.Rename(cryptsetup, cryptsetup+".orig"); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := os.Rename(cryptsetup+".orig", cryptsetup); err != nil {
+				t.Fatal(err)
+			}
+		}()
+
+		if !e.suspend(r) {
+			t.Errorf("expected suspend to fail")
+		}
+		e.checkRestored(r)
+	})
+
+	t.Run("suspend and resume", func(t *testing.T) {
+		e.t = t
+		r := &integrationRunner{}
+
+		cryptdevs, _ := e.cryptdevices()
+		for i := range cryptdevs {
+			if key, err := cryptKey(cryptdevs[i].Name); err != nil {
+				t.Fatal(err)
+			} else if strings.Trim(key, "0") == "" {
+				t.Fatalf("%s has no key before suspending", cryptdevs[i].Name)
+			}
+		}
+
+		// Inspect the system while it is "asleep", then wake it
+		asleep := make(chan struct{})
+		go func() {
+			defer close(asleep)
+
+			deadline := time.Now().Add(time.Minute)
+			for i := range cryptdevs {
+				for !cryptdevs[i].Suspended() {
+					if time.Now().After(deadline) {
+						t.Errorf("%s was never suspended", cryptdevs[i].Name)
+						return
+					}
+					time.Sleep(100 * time.Millisecond)
+				}
+				if key, err := cryptKey(cryptdevs[i].Name); err != nil {
+					t.Error(err)
+				} else if strings.Trim(key, "0") != "" {
+					t.Errorf("key of %s was not wiped: %s", cryptdevs[i].Name, key)
+				}
+			}
+
+			buf, err := ioutil.ReadFile(e.fifo)
+			if err != nil {
+				t.Error(err)
+			} else if string(buf) != "mem" {
+				t.Errorf("unexpected write to /sys/power/state: %#v", string(buf))
+			}
+		}()
+
+		if e.suspend(r) {
+			t.Errorf("suspend failed")
+		}
+
+		select {
+		case <-asleep:
+		case <-time.After(time.Minute):
+			t.Fatal("timed out waiting for suspend to RAM")
+		}
+
+		e.checkRestored(r)
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	g "goLuksSuspend"
+)
+
+// syslog(3) priorities
+const (
+	priorityErr     = 3
+	priorityWarning = 4
+	priorityInfo    = 6
+)
+
+func eventPriority(e *g.Event) int {
+	switch e.Kind {
+	case g.EventError:
+		return priorityErr
+	case g.EventUnlockFailed:
+		return priorityWarning
+	default:
+		return priorityInfo
+	}
+}
+
+// logEvents records the events reported by the initramfs in the journal.
+func logEvents(events []g.Event) error {
+	for i := range events {
+		e := &events[i]
+		fields := map[string]string{
+			"MESSAGE":               e.String(),
+			"PRIORITY":              strconv.Itoa(eventPriority(e)),
+			"SYSLOG_IDENTIFIER":     "go-luks-suspend",
+			"GO_LUKS_SUSPEND_EVENT": e.Kind.String(),
+			"GO_LUKS_SUSPEND_TIME":  e.Time.Format(time.RFC3339Nano),
+		}
+		if len(e.Device) > 0 {
+			fields["GO_LUKS_SUSPEND_DEVICE"] = e.Device
+		}
+		if len(e.Method) > 0 {
+			fields["GO_LUKS_SUSPEND_METHOD"] = e.Method
+		}
+		if len(e.Err) > 0 {
+			fields["GO_LUKS_SUSPEND_ERROR"] = e.Err
+		}
+		if err := g.SendJournal(fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stillSuspended returns the names of cryptdevices that the initramfs
+// reported suspending that remain suspended.
+func stillSuspended(cryptdevs []g.Cryptdevice, events []g.Event) []string {
+	suspended := map[string]bool{}
+	for i := range events {
+		if events[i].Kind == g.EventSuspended {
+			suspended[events[i].Device] = true
+		}
+	}
+
+	names := []string{}
+	for i := range cryptdevs {
+		if suspended[cryptdevs[i].Name] && cryptdevs[i].Suspended() {
+			names = append(names, cryptdevs[i].Name)
+		}
+	}
+
+	return names
+}
+
+// slept reports whether the initramfs reported waking from sleep.
+func slept(events []g.Event) bool {
+	for i := range events {
+		if events[i].Kind == g.EventWake {
+			return true
+		}
+	}
+	return false
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
+	"strings"
 	"syscall"
 
 	g "goLuksSuspend"
@@ -11,74 +12,134 @@ import (
 	"github.com/guns/golibs/sys"
 )
 
-var systemdServices = []string{
-	// journald may attempt to write to root device
-	"syslog.socket",
-	"systemd-journald.socket",
-	"systemd-journald-dev-log.socket",
-	"systemd-journald-audit.socket",
-	"systemd-journald.service",
-	// udevd often attempts to read from the root device
-	"systemd-udevd-control.socket",
-	"systemd-udevd-kernel.socket",
-	"systemd-udevd.service",
-}
-
-const initramfsDir = "/run/initramfs"
+// This is a variable to facilitate testing.
+var initramfsDir = "/run/initramfs"
 
 func main() {
+	defer g.Exit()
+
 	g.ParseFlags()
 
+	if flag.Arg(0) == "check" {
+		status := runCheck(flag.Args()[1:])
+		g.EndSimulation()
+		os.Exit(status)
+	}
+
+	g.AbortOnSignal(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	g.Debug("loading configuration")
+	conf, err := g.LoadConfig()
+	g.Assert(err)
+	g.SetConfig(conf)
+	g.Debug(fmt.Sprintf("%#v", conf))
+
 	g.Debug("disabling ISIG in TTY")
 	restoreTTY, err := sys.AlterTTY(os.Stdin.Fd(), sys.TCSETS, func(tty *syscall.Termios) {
 		tty.Lflag &^= syscall.ISIG
 	})
 	if restoreTTY != nil {
-		defer func() {
-			g.Debug("restoring TTY to original state")
-			g.Assert(restoreTTY())
-		}()
+		g.Rollback.Push("TTY settings", restoreTTY)
 	}
 	if err != nil {
 		g.Warn(err.Error())
 	}
 
+	g.Debug("verifying suspend program in initramfs")
+	g.Assert(verifyInitramfsBinary(initramfsProgram()))
+
+	if g.Conf.VerifyCryptsetup {
+		g.Debug("verifying cryptsetup in initramfs")
+		g.Assert(verifyInitramfsCryptsetup())
+	}
+
 	g.Debug("checking suspend program in initramfs")
-	g.Assert(checkInitramfsBinary(filepath.Join(initramfsDir, "suspend")))
+	caps, err := initramfsCapabilities(initramfsProgram())
+	g.Assert(err)
+	g.Debug(fmt.Sprintf("%#v", caps))
 
 	g.Debug("gathering cryptdevices")
 	cryptdevs, cdmap, err := g.GetCryptdevices()
 	g.Assert(err)
+
+	g.Debug("applying options from /etc/crypttab")
+	g.Assert(g.AddCrypttabOptions(cryptdevs, cdmap))
+
+	g.Debug("negotiating with suspend program in initramfs")
+	warnings, err := caps.Negotiate(cryptdevs)
+	g.Assert(err)
+	for _, w := range warnings {
+		g.Warn("[WARNING] " + w)
+	}
 	if g.DebugMode {
 		for i := range cryptdevs {
-			g.Debug(fmt.Sprintf("Name:%#v IsRootDevice:%#v",
+			g.Debug(fmt.Sprintf("Name:%#v Format:%s Integrity:%#v DependsOn:%#v IsBootDevice:%#v Policy:%#v",
 				cryptdevs[i].Name,
-				cryptdevs[i].IsRootDevice,
+				cryptdevs[i].Format,
+				cryptdevs[i].Integrity,
+				cryptdevs[i].DependsOn,
+				cryptdevs[i].IsBootDevice,
+				cryptdevs[i].Policy,
 			))
 		}
 	}
 
+	// Closed cryptdevices hold no keys and need not be resumed
+	g.Debug("applying cryptdevice policies")
+	active := len(cryptdevs)
+	cryptdevs, cdmap, err = applyDevicePolicies(cryptdevs, cdmap)
+	g.Check(g.PhasePreSuspend, err)
+
 	if len(cryptdevs) == 0 {
-		g.IgnoreErrors = true
+		if active == 0 {
+			g.Warn("no cryptdevices found, doing normal suspend")
+		} else {
+			g.Warn("all cryptdevices were closed or ignored by policy, doing normal suspend")
+		}
 	}
 
-	g.Debug("running pre-suspend scripts")
-	g.Assert(runSystemSuspendScripts("pre"))
+	suspend(cryptdevs, cdmap, caps)
+}
 
+// suspend locks cryptdevs in the initramfs chroot, suspends to RAM, and
+// restores the system once the boot devices have been unlocked. Each step
+// registers its compensating action on g.Rollback, which is unwound when
+// suspend returns, or earlier on failure. Failures are handled by the
+// policy of the phase they occur in.
+func suspend(cryptdevs []g.Cryptdevice, cdmap map[string]*g.Cryptdevice, caps g.Capabilities) {
 	defer func() {
-		g.Debug("running post-suspend scripts")
-		g.Assert(runSystemSuspendScripts("post"))
+		g.Check(g.PhasePostResume, g.Rollback.Unwind())
 	}()
 
 	if len(cryptdevs) == 0 {
-		g.Warn("no cryptdevices found, doing normal suspend")
-		g.Assert(g.SuspendToRAM())
+		g.Debug("running pre-suspend scripts")
+		if err := runSystemSuspendScripts("pre"); err != nil {
+			g.Warn(err.Error())
+		}
+		g.Rollback.Push("pre-suspend scripts", func() error {
+			return runSystemSuspendScripts("post")
+		})
+
+		g.Check(g.PhaseSleep, g.SuspendToRAM())
 		return
 	}
 
-	g.Debug("gathering filesystems with write barriers")
-	filesystems, err := getFilesystemsWithWriteBarriers()
-	g.Assert(err)
+	g.Debug("running pre-suspend scripts")
+	g.Check(g.PhasePreSuspend, runSystemSuspendScripts("pre"))
+
+	g.Rollback.Push("pre-suspend scripts", func() error {
+		return runSystemSuspendScripts("post")
+	})
+
+	g.Debug("gathering filesystems and swap areas on cryptdevices")
+	deps, err := g.ResolveDependents(cryptdevs)
+	g.Check(g.PhaseFreeze, err)
+	for _, d := range deps {
+		g.Debug(fmt.Sprintf("%s %s (%s) is on %s", d.Kind, d.Path, d.Type, strings.Join(d.Cryptdevices, ", ")))
+	}
+
+	filesystems, err := getFilesystemsToFreeze(deps)
+	g.Check(g.PhaseFreeze, err)
 	if g.DebugMode {
 		for i := range filesystems {
 			g.Debug(fmt.Sprintf("%#v", filesystems[i]))
@@ -88,59 +149,76 @@ func main() {
 	g.Debug("preparing initramfs chroot")
 	g.Assert(bindInitramfs())
 
-	defer func() {
-		g.Debug("unmounting initramfs bind mounts")
-		g.Assert(unbindInitramfs())
-	}()
-
+	// Some services may have stopped even if others failed to
 	g.Debug("stopping selected system services")
-	services, err := stopSystemServices(systemdServices)
-	g.Assert(err)
-
-	servicesRestarted := false
-
-	defer func() {
-		if !servicesRestarted {
-			g.Debug("starting previously stopped system services")
-			g.Assert(startSystemServices(services))
-		}
-	}()
+	services, err := stopSystemServices(g.Conf.SystemdServices)
+	g.Rollback.Push("stopped services", func() error {
+		return startSystemServices(services)
+	})
+	g.Check(g.PhaseServices, err)
 
 	g.Debug("flushing pending writes")
 	syscall.Sync()
 
-	g.Debug("disabling write barriers on filesystems to avoid IO hangs")
-	g.Assert(disableWriteBarriers(filesystems))
+	g.Debug("freezing filesystems on cryptdevices")
+	g.Rollback.Push("frozen filesystems", func() error {
+		frozen, err := thawFilesystems(filesystems, cdmap)
+		for _, mp := range frozen {
+			g.Warn(fmt.Sprintf("[WARNING] %s remains frozen; thaw it with `fsfreeze --unfreeze %s` once its cryptdevices are resumed", mp, mp))
+		}
+		return err
+	})
+	g.Check(g.PhaseFreeze, freezeFilesystems(filesystems))
+
+	// Pushed ahead of the initramfs so that a failure at any point resumes
+	// whichever cryptdevices it suspended. Those that are not suspended are
+	// skipped.
+	var events []g.Event
+	g.Rollback.Push("suspended cryptdevices", func() error {
+		// Safe to grab keyfile info after root device is unlocked
+		g.Debug("gathering keyfiles from /etc/crypttab")
+		err := g.AddKeyfilesFromCrypttab(cdmap)
+		if g.DebugMode {
+			for i := range cryptdevs {
+				if cryptdevs[i].Keyfile.Defined() {
+					g.Debug(fmt.Sprintf("%#v", cryptdevs[i].Keyfile))
+				}
+			}
+		}
 
-	defer func() {
-		g.Debug("re-enabling write barriers on filesystems")
-		enableWriteBarriers(filesystems)
-	}()
+		resumeCryptdevicesWithKeyfiles(cryptdevs)
 
+		for _, name := range stillSuspended(cryptdevs, events) {
+			g.Warn(fmt.Sprintf("[WARNING] cryptdevice %s remains suspended; unlock it with `cryptsetup luksResume %s`", name, name))
+		}
+		return err
+	})
+
+	// Aborting on a signal while the root device is suspended would hang
 	g.Debug("calling suspend in initramfs chroot")
-	g.Assert(suspendInInitramfsChroot(cryptdevs))
+	g.Rollback.Critical(func() {
+		events, err = suspendInInitramfsChroot(cryptdevs)
+	})
+	g.ApplySimulatedEvents(events)
+	g.Check(g.PhaseSuspend, err)
 
-	// We need to start up udevd ASAP so we can detect new block devices
-	g.Debug("starting previously stopped system services")
-	g.Assert(startSystemServices(services))
-	servicesRestarted = true
+	// Services write to the filesystems on the unlocked boot devices as
+	// soon as they start. The others are thawed once their cryptdevices
+	// are resumed with keyfiles.
+	g.Debug("thawing filesystems on unlocked cryptdevices")
+	_, err = thawFilesystems(filesystems, cdmap)
+	g.Check(g.PhasePostResume, err)
 
-	defer func() {
-		g.Debug("resuming non-root cryptdevices with keyfiles")
-		resumeCryptdevicesWithKeyfiles(cryptdevs)
-	}()
-
-	// User has unlocked the root device, so let's be less paranoid
-	g.IgnoreErrors = true
+	// We need to start up udevd ASAP so we can detect new block devices
+	g.Check(g.PhasePostResume, g.Rollback.Run("stopped services"))
 
-	// Safe to grab keyfile info after root device is unlocked
-	g.Debug("gathering keyfiles from /etc/crypttab")
-	g.Assert(g.AddKeyfilesFromCrypttab(cdmap))
-	if g.DebugMode {
-		for i := range cryptdevs {
-			if cryptdevs[i].Keyfile.Defined() {
-				g.Debug(fmt.Sprintf("%#v", cryptdevs[i].Keyfile))
-			}
-		}
+	// journald has been restarted, so what happened in the initramfs can
+	// now be recorded
+	g.Debug("logging initramfs events to the journal")
+	if err := logEvents(events); err != nil {
+		g.Warn("[WARNING] " + err.Error())
+	}
+	if caps.Events && !slept(events) && !g.DebugMode {
+		g.Warn("[WARNING] the system did not sleep")
 	}
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// simulateSuspend builds go-luks-suspend and initramfs-suspend into dir, and
+// runs a simulated suspend with the simulation spec. It returns the output,
+// and whether the program failed.
+func simulateSuspend(t *testing.T, dir, spec string) (out string, failed bool) {
+	if testing.Short() {
+		t.Skip("skipping simulation in short mode")
+	}
+
+	for _, prog := range []string{"go-luks-suspend", "initramfs-suspend"} {
+		build := exec.Command("go", "build", "-o", filepath.Join(dir, prog), "goLuksSuspend/cmd/"+prog)
+		if buf, err := build.CombinedOutput(); err != nil {
+			t.Fatalf("building %s: %s\n%s", prog, err.Error(), buf)
+		}
+	}
+
+	path := filepath.Join(dir, "simulation.json")
+	if err := ioutil.WriteFile(path, []byte(spec), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(filepath.Join(dir, "go-luks-suspend"), "-simulate", path)
+	buf, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); !ok && err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf), err != nil
+}
+
+func TestSimulatedInitramfsFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-luks-suspend-simulation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir) // errcheck: rm -rf
+	}()
+
+	keyfile := filepath.Join(dir, "data.key")
+	if err := ioutil.WriteFile(keyfile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The initramfs gives up after suspending cryptdata, so cryptdata must
+	// be resumed with its keyfile while the rest is unwound
+	out, failed := simulateSuspend(t, dir, `{"devices": [
+		{"name": "cryptroot", "format": "luks2", "boot": true, "passphrase": "hunter2"},
+		{"name": "cryptdata", "format": "luks1", "keyfile": "`+keyfile+`"},
+		{"name": "cryptswap", "format": "luks2", "failSuspend": true}
+	]}`)
+
+	if !failed {
+		t.Errorf("expected suspend to fail:\n%s", out)
+	}
+	for _, s := range []string{"luksSuspend cryptdata", "luksSuspend cryptswap", "cryptdata resumed", "systemctl start"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("%#v missing from output:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "remains suspended") {
+		t.Errorf("cryptdevice left suspended:\n%s", out)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	g "goLuksSuspend"
+
+	"github.com/guns/golibs/errutil"
+)
+
+const installedInitramfsBinary = "/usr/lib/go-luks-suspend/initramfs-suspend"
+
+// Directories searched for shared libraries, in the initramfs and on the
+// running system
+var libraryDirs = []string{"/usr/lib", "/lib", "/usr/lib64", "/lib64"}
+
+func fileDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// A digestMismatchError is returned when a file in the initramfs differs
+// from its counterpart on the running system.
+type digestMismatchError struct {
+	path, reference string
+}
+
+func (e *digestMismatchError) Error() string {
+	return fmt.Sprintf("%s does not match %s", e.path, e.reference)
+}
+
+func compareDigests(path, reference string) error {
+	a, err := fileDigest(path)
+	if err != nil {
+		return err
+	}
+
+	b, err := fileDigest(reference)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(a, b) {
+		return &digestMismatchError{path: path, reference: reference}
+	}
+
+	return nil
+}
+
+// verifyInitramfsBinary checks that the suspend program at path is
+// identical to the installed copy. On mismatch, the user is offered to
+// replace it if stdin is a terminal.
+func verifyInitramfsBinary(path string) error {
+	if g.SimulateMode {
+		g.Plan("verify " + filepath.Join(initramfsDir, "suspend") + " against " + installedInitramfsBinary)
+		return nil
+	}
+
+	err := compareDigests(path, installedInitramfsBinary)
+	if _, ok := err.(*digestMismatchError); !ok {
+		return err
+	}
+
+	if !isTerminal(os.Stdin) || !confirm(fmt.Sprintf("%s.\nReplace it with %s? [y/N] ", err.Error(), installedInitramfsBinary)) {
+		return fmt.Errorf("%s; refusing to run it. To refresh it, run `install -m755 %s %s`",
+			err.Error(), installedInitramfsBinary, path)
+	}
+
+	if err := refreshFile(installedInitramfsBinary, path, 0755); err != nil {
+		return err
+	}
+
+	return compareDigests(path, installedInitramfsBinary)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func confirm(prompt string) bool {
+	fmt.Print(prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
+// refreshFile atomically replaces dst with a copy of src.
+func refreshFile(src, dst string, mode os.FileMode) (err error) {
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name()) // errcheck: secondary error
+		}
+	}()
+
+	_, err = tmp.Write(buf)
+	err = errutil.First(err, tmp.Chmod(mode), tmp.Sync(), tmp.Close())
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+// verifyInitramfsCryptsetup checks that cryptsetup and the shared libraries
+// it links against are identical in the initramfs and on the running
+// system.
+func verifyInitramfsCryptsetup() error {
+	bin := g.Conf.Cryptsetup
+	if g.SimulateMode {
+		g.Plan("verify " + filepath.Join(initramfsDir, bin) + " and its libraries against " + bin)
+		return nil
+	}
+
+	errs := []error{compareDigests(filepath.Join(initramfsDir, bin), bin)}
+
+	libs, err := sharedLibraries(bin)
+	if err != nil {
+		return err
+	}
+
+	for _, lib := range libs {
+		path, ok := findLibrary(initramfsDir, lib)
+		if !ok {
+			errs = append(errs, errors.New(lib+" is missing from "+initramfsDir))
+			continue
+		}
+		errs = append(errs, compareDigests(filepath.Join(initramfsDir, path), path))
+	}
+
+	return errutil.Join(" • ", errs...)
+}
+
+// sharedLibraries returns the DT_NEEDED entries of the ELF file at path.
+func sharedLibraries(path string) ([]string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	libs, err := f.ImportedLibraries()
+	return libs, errutil.First(err, f.Close())
+}
+
+// findLibrary returns the path of lib relative to root.
+func findLibrary(root, lib string) (string, bool) {
+	for _, dir := range libraryDirs {
+		path := filepath.Join(dir, lib)
+		if _, err := os.Stat(filepath.Join(root, path)); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
@@ -1,75 +1,290 @@
 package main
 
 import (
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"runtime"
+	"sync"
 	"syscall"
+	"time"
 
 	g "goLuksSuspend"
 
 	"github.com/guns/golibs/editreader"
+	"github.com/guns/golibs/errutil"
 	"github.com/guns/golibs/sys"
 )
 
-func loadCryptdevices(r io.Reader) (cryptdevs []g.Cryptdevice, err error) {
-	err = gob.NewDecoder(r).Decode(&cryptdevs)
-	return cryptdevs, err
+// loadCryptdevices decodes the configuration and cryptdevices sent by
+// go-luks-suspend, and verifies that the devices are unchanged.
+func loadCryptdevices(r io.Reader) (conf g.Config, cryptdevs []g.Cryptdevice, err error) {
+	conf, cryptdevs, err = g.DecodeHandoff(r)
+	if err != nil {
+		return conf, nil, err
+	}
+	for i := range cryptdevs {
+		if err = cryptdevs[i].Verify(); err != nil {
+			return conf, nil, err
+		}
+	}
+	return conf, cryptdevs, nil
 }
 
-func suspendCryptdevices(cryptdevs []g.Cryptdevice) error {
-	// Iterate backwards so that we suspend the root device last. This prevents
-	// a logical deadlock in which a cryptdevice is actually a file on the root
-	// device. There is no way of solving this problem in the general case
-	// without building a directed graph of cryptdevices -> cryptdevices.
-	for i := len(cryptdevs) - 1; i >= 0; i-- {
-		if err := g.Cryptsetup("luksSuspend", cryptdevs[i].Name); err != nil {
-			return err
+// suspendCryptdevices suspends cryptdevs, and returns the boot devices it
+// suspended, which must be resumed even if it fails.
+func suspendCryptdevices(cryptdevs []g.Cryptdevice) (locked map[int]bool, err error) {
+	locked = map[int]bool{}
+
+	levels, err := g.ResumeLevels(cryptdevs)
+	if err != nil {
+		return locked, err
+	}
+
+	// Boot devices (which include the devices they depend on) are
+	// suspended last, one at a time, since this binary and cryptsetup may
+	// still need them. This also prevents a logical deadlock in which a
+	// cryptdevice is actually a file on the root device.
+	order, err := g.SuspendOrder(cryptdevs)
+	if err != nil {
+		return locked, err
+	}
+
+	bootChain := []int{}
+	for _, i := range order {
+		if cryptdevs[i].IsBootDevice {
+			bootChain = append(bootChain, i)
+		}
+	}
+
+	// Devices stacked on top of other cryptdevices (including containers
+	// backed by files on them) are suspended before the devices they
+	// depend on, so that no suspended device blocks the flush of another.
+	// Devices within a level do not depend on each other and are
+	// suspended concurrently.
+	failed := make([]bool, len(cryptdevs))
+	errs := []error{}
+
+	for l := len(levels) - 1; l >= 0; l-- {
+		level := []int{}
+		for _, i := range levels[l] {
+			if !cryptdevs[i].IsBootDevice {
+				level = append(level, i)
+			}
+		}
+		errs = append(errs, suspendLevel(cryptdevs, level, failed)...)
+	}
+
+	// Suspending the boot devices after a failure could leave the system
+	// without a way to investigate it.
+	if len(errs) > 0 {
+		return locked, errutil.Join(" • ", errs...)
+	}
+
+	for _, i := range bootChain {
+		if err := suspendCryptdevice(&cryptdevs[i]); err != nil {
+			return locked, fmt.Errorf("%s: %s", cryptdevs[i].Name, err.Error())
+		}
+		locked[i] = true
+
+		// Nothing may abort while any boot device is locked
+		g.EnterPhase(g.PhaseSleep)
+	}
+
+	return locked, nil
+}
+
+// suspendLevel concurrently suspends the cryptdevices in level, skipping
+// those that a previously failed device depends on. Failures are marked in
+// failed so that lower levels can be skipped in turn.
+func suspendLevel(cryptdevs []g.Cryptdevice, level []int, failed []bool) []error {
+	index := make(map[string]int, len(cryptdevs))
+	for i := range cryptdevs {
+		index[cryptdevs[i].Name] = i
+	}
+
+	for i := range cryptdevs {
+		if !failed[i] {
+			continue
+		}
+		for _, dep := range cryptdevs[i].DependsOn {
+			if j, ok := index[dep]; ok {
+				failed[j] = true
+			}
+		}
+	}
+
+	n := runtime.NumCPU()
+	errs := make([]error, len(level))
+	wg := sync.WaitGroup{}
+	ch := make(chan int)
+
+	wg.Add(1)
+	go func() {
+		for j := range level {
+			ch <- j
+		}
+		close(ch)
+		wg.Done()
+	}()
+
+	wg.Add(n)
+	for k := 0; k < n; k++ {
+		go func() {
+			for j := range ch {
+				cd := &cryptdevs[level[j]]
+				if failed[level[j]] {
+					errs[j] = fmt.Errorf("%s: not suspended because a device stacked upon it failed", cd.Name)
+					continue
+				}
+				if err := suspendCryptdevice(cd); err != nil {
+					errs[j] = fmt.Errorf("%s: %s", cd.Name, err.Error())
+				}
+			}
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+
+	for j := range level {
+		if errs[j] != nil {
+			failed[level[j]] = true
 		}
 	}
 
+	ret := []error{}
+	for j := range errs {
+		if errs[j] != nil {
+			ret = append(ret, errs[j])
+		}
+	}
+
+	return ret
+}
+
+func suspendCryptdevice(cd *g.Cryptdevice) error {
+	g.Debug("suspending " + cd.Name)
+	err := cd.Verify()
+	if err == nil {
+		err = cd.Suspend()
+	}
+	if err != nil {
+		g.ReportError(cd.Name, err)
+		return err
+	}
+	g.Report(g.Event{Kind: g.EventSuspended, Device: cd.Name})
+	return nil
+}
+
+// suspendToRAM suspends the system and reports when it sleeps and wakes.
+func suspendToRAM() error {
+	g.Report(g.Event{Kind: g.EventSleep})
+	if err := g.SuspendToRAM(); err != nil {
+		g.ReportError("", err)
+		return err
+	}
+	g.Report(g.Event{Kind: g.EventWake})
 	return nil
 }
 
 func startUdevDaemon() error {
-	return g.Run(exec.Command("/usr/lib/systemd/systemd-udevd", "--daemon", "--resolve-names=never"))
+	return g.Run(exec.Command(g.Conf.Udevd, "--daemon", "--resolve-names=never"))
 }
 
 func stopUdevDaemon() error {
-	return g.Run(exec.Command("/usr/bin/udevadm", "control", "--exit"))
+	return g.Run(exec.Command(g.Conf.Udevadm, "control", "--exit"))
 }
 
-func printPassphrasePrompt(rootdev *g.Cryptdevice) {
+func printPrompt(cd *g.Cryptdevice, u g.Unlocker) {
 	fmt.Print("\nPress Escape to suspend to RAM")
-	if rootdev.Keyfile.Defined() {
+	if cd.Keyfile.Defined() {
 		fmt.Print(", or Ctrl-R to rescan block devices for keyfiles")
 	}
 	if g.DebugMode {
 		fmt.Print(", or Ctrl-T to start a debug shell")
 	}
 	fmt.Println(".")
-	fmt.Printf("\nEnter passphrase for %s: ", rootdev.Name)
+	fmt.Print("\n" + u.Prompt(cd))
 }
 
-func luksResume(cd *g.Cryptdevice, stdin io.Reader) error {
-	if cd.Keyfile.Defined() {
-		if cd.Keyfile.Available() {
-			fmt.Printf("Attempting to unlock %s with keyfile...\n", cd.Name)
-			if err := cd.ResumeWithKeyfile(); err == nil {
-				return nil
+// configured reports whether u was set up for cd, as opposed to being one
+// of the default unlockers, which are skipped silently when unavailable.
+func configured(cd *g.Cryptdevice, u g.Unlocker) bool {
+	if u.Name() == "keyfile" {
+		return cd.Keyfile.Defined()
+	}
+	for _, name := range cd.UnlockWith {
+		if name == u.Name() {
+			return true
+		}
+	}
+	return false
+}
+
+// resumeBootCryptdevice makes one pass through the unlockers of cd, and
+// returns the error of the last one attempted.
+func resumeBootCryptdevice(cd *g.Cryptdevice) error {
+	var err error
+
+	for _, u := range cd.Unlockers() {
+		if !u.Available(cd) {
+			if configured(cd, u) {
+				fmt.Printf("%s unavailable for %s.\n", u.Name(), cd.Name)
 			}
+			continue
+		}
+
+		if len(u.Prompt(cd)) == 0 {
+			fmt.Printf("Attempting to unlock %s with %s...\n", cd.Name, u.Name())
+			err = u.Unlock(cd, nil)
 		} else {
-			fmt.Println("Keyfile unavailable.")
+			err = unlockInteractively(cd, u)
+		}
+
+		if err == nil {
+			g.Report(g.Event{Kind: g.EventResumed, Device: cd.Name, Method: u.Name()})
+			return nil
+		}
+
+		g.Report(g.Event{Kind: g.EventUnlockFailed, Device: cd.Name, Method: u.Name(), Err: err.Error()})
+		g.Debug(fmt.Sprintf("%s: %s failed: %s", cd.Name, u.Name(), err.Error()))
+		printUnlockError(cd, u, err)
+
+		// No other unlocker can succeed either
+		if errors.Is(err, g.ErrDeviceNotFound) || errors.Is(err, g.ErrCommandMissing) {
+			return err
+		}
+
+		// Give whatever holds the device a moment to release it
+		if errors.Is(err, g.ErrDeviceBusy) {
+			time.Sleep(time.Second)
 		}
 	}
 
-	printPassphrasePrompt(cd)
-	return cd.Resume(stdin)
+	return err
+}
+
+func printUnlockError(cd *g.Cryptdevice, u g.Unlocker, err error) {
+	switch {
+	case errors.Is(err, g.ErrWrongPassphrase):
+		fmt.Printf("Incorrect %s for %s.\n", u.Name(), cd.Name)
+	case errors.Is(err, g.ErrNoYubikey):
+		fmt.Printf("No YubiKey inserted; unable to unlock %s.\n", cd.Name)
+	case errors.Is(err, g.ErrDeviceNotFound):
+		fmt.Printf("%s not found.\n", cd.Name)
+	case errors.Is(err, g.ErrDeviceBusy):
+		fmt.Printf("%s is busy; retrying.\n", cd.Name)
+	case errors.Is(err, g.ErrCommandMissing):
+		fmt.Printf("Unable to unlock %s: %s\n", cd.Name, err.Error())
+	default:
+		fmt.Printf("Failed to unlock %s with %s: %s\n", cd.Name, u.Name(), err.Error())
+	}
 }
 
-func resumeRootCryptdevice(rootdev *g.Cryptdevice) error {
+func unlockInteractively(cd *g.Cryptdevice, u g.Unlocker) error {
 	restoreTTY, err := sys.AlterTTY(os.Stdin.Fd(), sys.TCSETSF, func(tty *syscall.Termios) {
 		tty.Lflag &^= syscall.ICANON | syscall.ECHO
 	})
@@ -79,14 +294,15 @@ func resumeRootCryptdevice(rootdev *g.Cryptdevice) error {
 	if restoreTTY != nil {
 		defer func() {
 			if !ttyRestored {
-				g.Assert(restoreTTY())
+				g.Check(g.PhaseUnlock, restoreTTY())
 			}
 		}()
 	}
 
 	if err != nil {
 		g.Warn(err.Error())
-		return luksResume(rootdev, os.Stdin)
+		printPrompt(cd, u)
+		return u.Unlock(cd, os.Stdin)
 	}
 
 	// The `secure` parameter to editreader.New zeroes memory aggressively
@@ -94,22 +310,22 @@ func resumeRootCryptdevice(rootdev *g.Cryptdevice) error {
 		switch b {
 		case 0x1b: // ^[
 			g.Debug("suspending to RAM")
-			g.Assert(g.SuspendToRAM())
+			g.Check(g.PhaseSleep, suspendToRAM())
 			fmt.Println()
-			printPassphrasePrompt(rootdev)
+			printPrompt(cd, u)
 			return editreader.Kill
 		case 0x17: // ^W
 			return editreader.Kill
 		case '\n':
 			fmt.Println()
-			g.Assert(restoreTTY())
+			g.Check(g.PhaseUnlock, restoreTTY())
 			ttyRestored = true
 			return editreader.Append | editreader.Flush | editreader.Close
 		case 0x03: // ^C
 			fmt.Println()
 			return editreader.Kill | editreader.Flush | editreader.Close
 		case 0x12: // ^R
-			if rootdev.Keyfile.Defined() {
+			if cd.Keyfile.Defined() {
 				fmt.Println()
 				return editreader.Kill | editreader.Flush | editreader.Close
 			}
@@ -118,7 +334,7 @@ func resumeRootCryptdevice(rootdev *g.Cryptdevice) error {
 			if g.DebugMode {
 				fmt.Println()
 				g.DebugShell()
-				printPassphrasePrompt(rootdev)
+				printPrompt(cd, u)
 				return editreader.Kill
 			}
 			fallthrough
@@ -127,5 +343,6 @@ func resumeRootCryptdevice(rootdev *g.Cryptdevice) error {
 		}
 	})
 
-	return luksResume(rootdev, r)
+	printPrompt(cd, u)
+	return u.Unlock(cd, r)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+
+	g "goLuksSuspend"
+	"goLuksSuspend/internal/roottest"
+	"goLuksSuspend/internal/runnertest"
+)
+
+func TestBootChainFailureTranscript(t *testing.T) {
+	defer roottest.TempRoot(t, &g.Root, map[string]string{
+		"inner.key":                   "secret",
+		"sys/block/dm-0/dev":          "254:0\n",
+		"sys/block/dm-0/dm/name":      "cryptouter\n",
+		"sys/block/dm-0/dm/uuid":      "CRYPT-LUKS2-00000000000000000000000000000000-cryptouter\n",
+		"sys/block/dm-0/dm/suspended": "0\n",
+		"sys/block/dm-1/dev":          "254:1\n",
+		"sys/block/dm-1/dm/name":      "cryptinner\n",
+		"sys/block/dm-1/dm/uuid":      "CRYPT-LUKS2-11111111111111111111111111111111-cryptinner\n",
+		"sys/block/dm-1/dm/suspended": "0\n",
+	})()
+
+	// cryptouter ─ cryptinner, both unlocked in the initramfs
+	buf := bytes.Buffer{}
+	err := gob.NewEncoder(&buf).Encode(&g.Handoff{
+		Version: g.WireVersion,
+		Config:  g.DefaultConfig(),
+		Devices: []g.DeviceDescriptor{
+			{
+				Name:         "cryptouter",
+				UUID:         "CRYPT-LUKS2-00000000000000000000000000000000-cryptouter",
+				DMDir:        "/sys/block/dm-0/dm",
+				Major:        254,
+				Minor:        0,
+				Format:       g.LUKS2,
+				IsBootDevice: true,
+			},
+			{
+				Name:         "cryptinner",
+				UUID:         "CRYPT-LUKS2-11111111111111111111111111111111-cryptinner",
+				DMDir:        "/sys/block/dm-1/dm",
+				Major:        254,
+				Minor:        1,
+				Format:       g.LUKS2,
+				DependsOn:    []string{"cryptouter"},
+				Keyfile:      g.Keyfile{Path: "/inner.key"},
+				IsBootDevice: true,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cryptdevs, err := loadCryptdevices(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer g.EnterPhase("")
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("aborted with the boot devices locked: %v", r)
+		}
+	}()
+
+	runnertest.With(func(r *runnertest.Runner) {
+		// cryptinner is locked by the time cryptouter fails
+		r.On(g.Conf.Cryptsetup+" luksSuspend cryptouter", runnertest.Result{Err: g.ExitStatus(5)})
+
+		suspend(cryptdevs)
+
+		expected := []string{
+			g.Conf.Udevd + " --daemon --resolve-names=never",
+			g.Conf.Cryptsetup + " luksSuspend cryptinner",
+			g.Conf.Cryptsetup + " luksSuspend cryptouter",
+			g.Conf.Cryptsetup + " --key-file /inner.key --type luks2 luksResume cryptinner",
+			g.Conf.Udevadm + " control --exit",
+		}
+		if got := r.Transcript(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%#v != %#v", got, expected)
+		}
+	})
+}
@@ -1,74 +1,166 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"syscall"
 
 	g "goLuksSuspend"
 )
 
 func main() {
+	defer g.Exit()
+
 	g.ParseFlags()
 
+	// udevd and cryptsetup must not inherit the handoff and event pipes
+	syscall.CloseOnExec(3)
+	syscall.CloseOnExec(4)
+
 	g.Debug("loading cryptdevices")
 	r := os.NewFile(uintptr(3), "r")
-	cryptdevs, err := loadCryptdevices(r)
+	conf, cryptdevs, err := loadCryptdevices(r)
 	g.Assert(err)
 	g.Assert(r.Close())
+	g.SetConfig(conf)
+
+	events := os.NewFile(uintptr(4), "events")
+	g.SetEventWriter(events)
+	defer func() {
+		g.SetEventWriter(nil)
+		g.Check(g.PhasePostResume, events.Close())
+	}()
 
 	if len(cryptdevs) == 0 {
 		// This branch should be impossible.
 		g.Warn("no cryptdevices found, doing normal suspend")
-		g.Assert(g.SuspendToRAM())
+		g.Check(g.PhaseSleep, suspendToRAM())
 		return
 	}
 
-	if cryptdevs[0].Keyfile.Defined() {
+	suspend(cryptdevs)
+}
+
+// suspend locks cryptdevs, suspends to RAM, and unlocks the boot devices
+// on wake. Once a boot device is suspended, every failure leads to the
+// unlock prompt instead of an exit.
+func suspend(cryptdevs []g.Cryptdevice) {
+	needUdev := false
+	for i := range cryptdevs {
+		if cryptdevs[i].IsBootDevice && cryptdevs[i].Keyfile.Defined() {
+			needUdev = true
+		}
+	}
+
+	defer func() {
+		if err := g.Rollback.Unwind(); err != nil {
+			g.Warn("[ERROR] " + err.Error())
+		}
+	}()
+
+	if needUdev {
 		g.Debug("starting udevd from initramfs")
 		g.Assert(startUdevDaemon())
-
-		defer func() {
-			g.Debug("stopping udevd within initramfs")
-			g.Assert(stopUdevDaemon())
-		}()
+		g.Rollback.Push("udevd", stopUdevDaemon)
 	}
 
 	g.Debug("suspending cryptdevices")
-	g.Assert(suspendCryptdevices(cryptdevs))
+	locked, err := suspendCryptdevices(cryptdevs)
+	if len(locked) == 0 {
+		g.Check(g.PhaseSuspend, err)
+	}
+
+	// The boot devices are locked from here on, so nothing may abort
+	// until they are unlocked
+	g.EnterPhase(g.PhaseSleep)
+
+	if err != nil {
+		// Part of the boot chain is locked, and must be unlocked again
+		// without sleeping
+		g.Warn("[ERROR] " + err.Error() + "; unlocking the suspended boot devices")
+	} else {
+		sleep()
+	}
+
+	// Every boot device must be unlocked before leaving the initramfs, in
+	// an order in which the devices they are stacked upon come first
+	g.EnterPhase(g.PhaseUnlock)
+	order, err := g.ResumeOrder(cryptdevs)
+	g.Check(g.PhaseUnlock, err)
 
-	// Crypt keys have been purged, so be less paranoid
-	g.IgnoreErrors = true
+	defer g.ForgetSecrets()
+	defer func() {
+		for i := range cryptdevs {
+			cryptdevs[i].Keyfile.Forget()
+		}
+	}()
 
-	// Shorten task freeze timeout
-	oldtimeout, err := g.SetFreezeTimeout([]byte{'1', '0', '0', '0'})
+	for _, i := range order {
+		if !locked[i] {
+			continue
+		}
+		g.Debug("resuming " + cryptdevs[i].Name)
+		resumeCryptdeviceInteractively(&cryptdevs[i])
+	}
+
+	g.EnterPhase(g.PhasePostResume)
+}
+
+// sleep suspends to RAM with a shortened task freeze timeout.
+func sleep() {
+	oldtimeout, err := g.SetFreezeTimeout(g.Conf.FreezeTimeoutValue())
 	if err == nil {
-		defer func() {
-			_, e := g.SetFreezeTimeout(oldtimeout)
-			g.Assert(e)
-		}()
+		g.Rollback.Push("freeze timeout", func() error {
+			_, err := g.SetFreezeTimeout(oldtimeout)
+			return err
+		})
 	} else {
-		g.Assert(err)
+		g.Check(g.PhaseSleep, err)
 	}
 
 	if g.DebugMode {
 		g.Debug("debug: skipping suspend to RAM")
 	} else {
-		g.Assert(g.SuspendToRAM())
+		g.Check(g.PhaseSleep, suspendToRAM())
+	}
+}
+
+func resumeCryptdeviceInteractively(cd *g.Cryptdevice) {
+	if err := cd.Verify(); err != nil {
+		g.ReportError(cd.Name, err)
+		g.Warn("[WARNING] " + err.Error() + "; skipping")
+		return
+	}
+
+	if method, ok := cd.ResumeWithSharedSecret(); ok {
+		g.Report(g.Event{Kind: g.EventResumed, Device: cd.Name, Method: method})
+		return
 	}
 
-	g.Debug("resuming root cryptdevice")
 	for {
 		var err error
-		for i := 0; i < 3; i++ {
-			err = resumeRootCryptdevice(&cryptdevs[0])
+		for i := 0; i < g.Conf.UnlockAttempts; i++ {
+			err = resumeBootCryptdevice(cd)
 			if err == nil {
 				return
 			}
+			if errors.Is(err, g.ErrDeviceNotFound) && !cd.Exists() {
+				g.ReportError(cd.Name, err)
+				g.Warn(fmt.Sprintf("[WARNING] cryptdevice %s has disappeared; skipping", cd.Name))
+				return
+			}
+			if errors.Is(err, g.ErrCommandMissing) {
+				break
+			}
 		}
-		// The -poweroff flag indicates the user's desire to take the
-		// system offline on failure to unlock.
-		if g.PoweroffOnError {
-			g.IgnoreErrors = false
-			g.Assert(err)
+		g.Check(g.PhaseUnlock, err)
+
+		// Retrying without cryptsetup is pointless, and the boot devices
+		// cannot be unlocked by any other means
+		if errors.Is(err, g.ErrCommandMissing) {
+			g.Warn("[ERROR] cannot unlock " + cd.Name + " without cryptsetup; powering off")
+			g.Poweroff()
 		}
 	}
 }
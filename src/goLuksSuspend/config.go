@@ -0,0 +1,285 @@
+package goLuksSuspend
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// These are variables to facilitate testing.
+var (
+	configPath      = "/etc/go-luks-suspend.conf"
+	configDropinDir = "/etc/go-luks-suspend.conf.d"
+)
+
+// Config holds the settings of /etc/go-luks-suspend.conf. It is read by
+// go-luks-suspend and forwarded to the initramfs, so that both binaries
+// share the same settings.
+type Config struct {
+	// systemd units stopped while the root device is suspended
+	SystemdServices []string
+	// Value of /sys/power/pm_freeze_timeout while suspended
+	FreezeTimeout time.Duration
+	// Unlock attempts before the failure policy is applied
+	UnlockAttempts int
+	// Power off instead of aborting, or of retrying when a boot device
+	// cannot be unlocked
+	PoweroffOnError bool
+	// Action taken when each phase fails
+	OnFailure map[Phase]Action
+	// How long to wait for a YubiKey to be inserted
+	YubikeyTimeout time.Duration
+	// Refuse to suspend unless cryptsetup and its libraries in the
+	// initramfs are identical to those of the running system
+	VerifyCryptsetup bool
+	// Paths of external programs
+	Cryptsetup string
+	Systemctl  string
+	Ykchalresp string
+	Shell      string
+	Sulogin    string
+	Udevd      string
+	Udevadm    string
+
+	// SystemdServices has been assigned, so the defaults are replaced
+	servicesAssigned bool
+}
+
+// DefaultConfig returns the settings used when no configuration files
+// exist.
+func DefaultConfig() Config {
+	return Config{
+		SystemdServices: []string{
+			// journald may attempt to write to root device
+			"syslog.socket",
+			"systemd-journald.socket",
+			"systemd-journald-dev-log.socket",
+			"systemd-journald-audit.socket",
+			"systemd-journald.service",
+			// udevd often attempts to read from the root device
+			"systemd-udevd-control.socket",
+			"systemd-udevd-kernel.socket",
+			"systemd-udevd.service",
+		},
+		FreezeTimeout:  time.Second,
+		UnlockAttempts: 3,
+		OnFailure:      defaultFailurePolicy(),
+		YubikeyTimeout: 30 * time.Second,
+		Cryptsetup:     "/usr/bin/cryptsetup",
+		Systemctl:      "/usr/bin/systemctl",
+		Ykchalresp:     "/usr/bin/ykchalresp",
+		Shell:          "/bin/sh",
+		Sulogin:        "/usr/bin/sulogin",
+		Udevd:          "/usr/lib/systemd/systemd-udevd",
+		Udevadm:        "/usr/bin/udevadm",
+	}
+}
+
+// Conf holds the settings in effect.
+var Conf = DefaultConfig()
+
+// LoadConfig reads /etc/go-luks-suspend.conf followed by the *.conf files in
+// /etc/go-luks-suspend.conf.d in lexical order. Later settings override
+// earlier ones, except for SystemdServices: its first assignment replaces
+// the defaults, later ones append to it, and an empty assignment clears
+// it. Missing files are ignored.
+func LoadConfig() (Config, error) {
+	c := DefaultConfig()
+
+	paths, err := filepath.Glob(filepath.Join(RootPath(configDropinDir), "*.conf"))
+	if err != nil {
+		return c, err
+	}
+	sort.Strings(paths)
+
+	for _, path := range append([]string{RootPath(configPath)}, paths...) {
+		if err := c.readFile(path); err != nil {
+			return c, err
+		}
+	}
+
+	return c, c.Validate()
+}
+
+// SetConfig installs c as the settings in effect.
+func SetConfig(c Config) {
+	c.PoweroffOnError = c.PoweroffOnError || forcePoweroff
+	Conf = c
+}
+
+func (c *Config) readFile(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = c.parse(file, path)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// parse reads lines of the form Key = Value. Blank lines, lines starting
+// with # or ;, and [Section] headers are ignored.
+func (c *Config) parse(r io.Reader, name string) error {
+	s := bufio.NewScanner(r)
+	lineno := 0
+
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' || line[0] == '[' {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) < 2 {
+			return fmt.Errorf("%s:%d: expected Key = Value", name, lineno)
+		}
+
+		if err := c.set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])); err != nil {
+			return fmt.Errorf("%s:%d: %s", name, lineno, err.Error())
+		}
+	}
+
+	return s.Err()
+}
+
+func (c *Config) set(key, value string) (err error) {
+	switch key {
+	case "SystemdServices":
+		if len(value) == 0 || !c.servicesAssigned {
+			c.SystemdServices = nil
+		}
+		c.SystemdServices = append(c.SystemdServices, strings.Fields(value)...)
+		c.servicesAssigned = true
+	case "FreezeTimeout":
+		c.FreezeTimeout, err = parseDuration(value)
+	case "UnlockAttempts":
+		c.UnlockAttempts, err = strconv.Atoi(value)
+	case "PoweroffOnError":
+		c.PoweroffOnError, err = parseStrictBool(value)
+	case "YubikeyTimeout":
+		c.YubikeyTimeout, err = parseDuration(value)
+	case "VerifyCryptsetup":
+		c.VerifyCryptsetup, err = parseStrictBool(value)
+	case "Cryptsetup":
+		c.Cryptsetup = value
+	case "Systemctl":
+		c.Systemctl = value
+	case "Ykchalresp":
+		c.Ykchalresp = value
+	case "Shell":
+		c.Shell = value
+	case "Sulogin":
+		c.Sulogin = value
+	case "Udevd":
+		c.Udevd = value
+	case "Udevadm":
+		c.Udevadm = value
+	default:
+		if !strings.HasPrefix(key, "OnFailure.") {
+			return fmt.Errorf("unknown setting %#v", key)
+		}
+		return c.setFailureAction(strings.TrimPrefix(key, "OnFailure."), value)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: invalid value %#v", key, value)
+	}
+
+	return nil
+}
+
+func (c *Config) setFailureAction(phase, action string) error {
+	p, err := parsePhase(phase)
+	if err != nil {
+		return errors.New("OnFailure." + phase + ": " + err.Error())
+	}
+
+	a, err := parseAction(action)
+	if err != nil {
+		return errors.New("OnFailure." + phase + ": " + err.Error())
+	}
+
+	// Copies of c share the map
+	policy := defaultFailurePolicy()
+	for k, v := range c.OnFailure {
+		policy[k] = v
+	}
+	policy[p] = a
+	c.OnFailure = policy
+
+	return nil
+}
+
+// parseDuration accepts a time.Duration string, or a plain number of
+// milliseconds.
+func parseDuration(s string) (time.Duration, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Duration(n) * time.Millisecond, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func parseStrictBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "1", "yes", "true", "on":
+		return true, nil
+	case "0", "no", "false", "off":
+		return false, nil
+	default:
+		return false, errors.New("invalid boolean")
+	}
+}
+
+// Validate reports the first setting of c that cannot be used.
+func (c *Config) Validate() error {
+	switch {
+	case c.FreezeTimeout < time.Millisecond:
+		return errors.New("FreezeTimeout must be at least 1ms")
+	case c.UnlockAttempts < 1:
+		return errors.New("UnlockAttempts must be at least 1")
+	case c.YubikeyTimeout < 0:
+		return errors.New("YubikeyTimeout must not be negative")
+	}
+
+	if err := validatePolicy(c.OnFailure); err != nil {
+		return err
+	}
+
+	paths := []struct{ key, path string }{
+		{"Cryptsetup", c.Cryptsetup},
+		{"Systemctl", c.Systemctl},
+		{"Ykchalresp", c.Ykchalresp},
+		{"Shell", c.Shell},
+		{"Sulogin", c.Sulogin},
+		{"Udevd", c.Udevd},
+		{"Udevadm", c.Udevadm},
+	}
+
+	for _, p := range paths {
+		if !filepath.IsAbs(p.path) {
+			return fmt.Errorf("%s must be an absolute path, not %#v", p.key, p.path)
+		}
+	}
+
+	return nil
+}
+
+// FreezeTimeoutValue returns FreezeTimeout formatted for
+// /sys/power/pm_freeze_timeout.
+func (c *Config) FreezeTimeoutValue() []byte {
+	return []byte(strconv.FormatInt(int64(c.FreezeTimeout/time.Millisecond), 10))
+}
@@ -0,0 +1,149 @@
+package goLuksSuspend
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigParsing(t *testing.T) {
+	data := []struct {
+		in       string
+		expected func(c *Config)
+		err      bool
+	}{
+		{in: "", expected: func(c *Config) {}},
+		{
+			in: "# comment\n[Suspend]\nFreezeTimeout = 2s\nUnlockAttempts=5\nPoweroffOnError = yes\n",
+			expected: func(c *Config) {
+				c.FreezeTimeout = 2 * time.Second
+				c.UnlockAttempts = 5
+				c.PoweroffOnError = true
+			},
+		},
+		{
+			in: "FreezeTimeout = 500\nYubikeyTimeout = 1m\nVerifyCryptsetup = on\n",
+			expected: func(c *Config) {
+				c.FreezeTimeout = 500 * time.Millisecond
+				c.YubikeyTimeout = time.Minute
+				c.VerifyCryptsetup = true
+			},
+		},
+		{
+			in: "SystemdServices = foo.service bar.socket\nSystemdServices = baz.service\n",
+			expected: func(c *Config) {
+				c.SystemdServices = []string{"foo.service", "bar.socket", "baz.service"}
+				c.servicesAssigned = true
+			},
+		},
+		{
+			in: "SystemdServices = foo.service\nSystemdServices =\nSystemdServices = baz.service\n",
+			expected: func(c *Config) {
+				c.SystemdServices = []string{"baz.service"}
+				c.servicesAssigned = true
+			},
+		},
+		{
+			in: "SystemdServices =\n",
+			expected: func(c *Config) {
+				c.SystemdServices = nil
+				c.servicesAssigned = true
+			},
+		},
+		{
+			in:       "Cryptsetup = /sbin/cryptsetup\n",
+			expected: func(c *Config) { c.Cryptsetup = "/sbin/cryptsetup" },
+		},
+		{
+			in:       "Udevd = /lib/systemd/systemd-udevd\nUdevadm = /bin/udevadm\n",
+			expected: func(c *Config) { c.Udevd, c.Udevadm = "/lib/systemd/systemd-udevd", "/bin/udevadm" },
+		},
+		{
+			in: "OnFailure.Services = continue\nOnFailure.Unlock = poweroff\n",
+			expected: func(c *Config) {
+				c.OnFailure[PhaseServices] = ActionContinue
+				c.OnFailure[PhaseUnlock] = ActionPoweroff
+			},
+		},
+		{in: "FreezeTimeout\n", err: true},
+		{in: "Unknown = 1\n", err: true},
+		{in: "UnlockAttempts = three\n", err: true},
+		{in: "PoweroffOnError = maybe\n", err: true},
+		{in: "FreezeTimeout = soon\n", err: true},
+		{in: "OnFailure.Sleeping = continue\n", err: true},
+		{in: "OnFailure.Sleep = retry\n", err: true},
+	}
+
+	for _, row := range data {
+		c := DefaultConfig()
+		err := c.parse(strings.NewReader(row.in), "test")
+		if (err != nil) != row.err {
+			t.Errorf("%#v: unexpected error: %#v", row.in, err)
+		}
+		if err != nil {
+			continue
+		}
+		expected := DefaultConfig()
+		row.expected(&expected)
+		if !reflect.DeepEqual(c, expected) {
+			t.Errorf("%#v: %#v != %#v", row.in, c, expected)
+		}
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	data := []struct {
+		modify func(c *Config)
+		err    bool
+	}{
+		{modify: func(c *Config) {}},
+		{modify: func(c *Config) { c.UnlockAttempts = 0 }, err: true},
+		{modify: func(c *Config) { c.FreezeTimeout = 0 }, err: true},
+		{modify: func(c *Config) { c.Systemctl = "systemctl" }, err: true},
+		{modify: func(c *Config) { c.Udevd = "systemd-udevd" }, err: true},
+		{modify: func(c *Config) { c.OnFailure = map[Phase]Action{PhaseSuspend: ActionShell} }},
+		{modify: func(c *Config) { c.OnFailure = map[Phase]Action{PhaseUnlock: ActionAbort} }, err: true},
+	}
+
+	for i, row := range data {
+		c := DefaultConfig()
+		row.modify(&c)
+		if err := c.Validate(); (err != nil) != row.err {
+			t.Errorf("%d: unexpected error: %#v", i, err)
+		}
+	}
+
+	c := DefaultConfig()
+	if v := string(c.FreezeTimeoutValue()); v != "1000" {
+		t.Errorf("%#v != %#v", v, "1000")
+	}
+}
+
+// Uncommenting every setting of the shipped configuration file must not
+// change anything.
+func TestShippedConfig(t *testing.T) {
+	buf, err := ioutil.ReadFile("../../go-luks-suspend.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(string(buf), "\n")
+	for i := range lines {
+		if strings.HasPrefix(lines[i], "#") && strings.Contains(lines[i], " = ") {
+			lines[i] = strings.TrimPrefix(lines[i], "#")
+		}
+	}
+
+	c := DefaultConfig()
+	if err := c.parse(strings.NewReader(strings.Join(lines, "\n")), "go-luks-suspend.conf"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := DefaultConfig()
+	expected.servicesAssigned = true
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("%#v != %#v", c, expected)
+	}
+}
@@ -3,61 +3,144 @@ package goLuksSuspend
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"syscall"
 
 	"github.com/guns/golibs/errutil"
 )
 
+type LUKSFormat uint8
+
+const (
+	LUKS1 LUKSFormat = iota + 1
+	LUKS2
+)
+
+func (f LUKSFormat) String() string {
+	switch f {
+	case LUKS1:
+		return "luks1"
+	case LUKS2:
+		return "luks2"
+	default:
+		return "unknown"
+	}
+}
+
 type Cryptdevice struct {
-	Name         string
-	uuid         []byte
-	dmdir        string
+	Name   string
+	Format LUKSFormat
+	// Name of the dm-integrity subdevice of an authenticated LUKS2
+	// volume, if any. It holds no key material and is not suspended.
+	Integrity string
+	// Names of the cryptdevices this device is stacked upon
+	DependsOn []string
+	// Names of the unlockers to attempt, in order; DefaultUnlockers if empty
+	UnlockWith []string
+	Yubikey    YubikeyOptions
+	// What happens to the device before suspend; suspend if empty
+	Policy DevicePolicy
+	uuid   []byte
+	dmdir  string
+	// Device numbers of the dm device
+	major, minor uint32
 	Keyfile      Keyfile
-	IsRootDevice bool
+	// Boot devices are unlocked before leaving the initramfs
+	IsBootDevice bool
+}
+
+// cryptsetup creates device-mapper UUIDs of the form
+//
+//	CRYPT-<TYPE>-<LUKS UUID without dashes>-<dm name>
+//
+// The dm-integrity device backing an authenticated LUKS2 volume is named
+// <dm name>_dif, has the type SUBDEV, and shares the LUKS UUID of its parent.
+const (
+	dmUUIDPrefix    = "CRYPT-"
+	dmTypeLUKS1     = "LUKS1"
+	dmTypeLUKS2     = "LUKS2"
+	dmTypeSubdev    = "SUBDEV"
+	integritySuffix = "_dif"
+)
+
+func parseDMUUID(uuid []byte) (typ, id string) {
+	s := string(bytes.TrimSuffix(uuid, []byte{'\n'}))
+	if !strings.HasPrefix(s, dmUUIDPrefix) {
+		return "", ""
+	}
+
+	fields := strings.SplitN(s[len(dmUUIDPrefix):], "-", 3)
+	if len(fields) < 2 {
+		return "", ""
+	}
+
+	return fields[0], fields[1]
 }
 
-var luksUUIDPrefix = []byte("CRYPT-LUKS1-")
+func dmTypeFormat(typ string) LUKSFormat {
+	switch typ {
+	case dmTypeLUKS1:
+		return LUKS1
+	case dmTypeLUKS2:
+		return LUKS2
+	default:
+		return 0
+	}
+}
 
 func GetCryptdevices() ([]Cryptdevice, map[string]*Cryptdevice, error) {
-	dirs, err := filepath.Glob("/sys/block/*/dm")
+	dirs, err := filepath.Glob(RootPath("/sys/block/*/dm"))
 	if err != nil || len(dirs) == 0 {
 		return nil, nil, err
 	}
 
-	rootdev, rootkey, err := parseKernelCmdline()
+	bootdevs, err := parseKernelCmdline()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	cryptdevs := make([]Cryptdevice, len(dirs))
-	cdmap := make(map[string]*Cryptdevice, len(dirs))
-	j, lastidx := 1, 0
+	cryptdevs := make([]Cryptdevice, 0, len(dirs))
+	subdevs := make(map[string]string)
+	hasBootDevice := false
 
 	for i := range dirs {
-		// Skip if not a LUKS device
-		uuid, err := ioutil.ReadFile(filepath.Join(dirs[i], "uuid"))
+		dirs[i] = unrootPath(dirs[i])
+
+		uuid, err := ioutil.ReadFile(RootPath(filepath.Join(dirs[i], "uuid")))
 		if err != nil {
 			return nil, nil, err
-		} else if len(uuid) < len(luksUUIDPrefix) ||
-			!bytes.Equal(uuid[:len(luksUUIDPrefix)], luksUUIDPrefix) {
+		}
+
+		typ, id := parseDMUUID(uuid)
+
+		// Integrity subdevices are attached to their parents below
+		if typ == dmTypeSubdev {
+			name, err := ioutil.ReadFile(RootPath(filepath.Join(dirs[i], "name")))
+			if err != nil {
+				return nil, nil, err
+			}
+			subdevs[id] = string(bytes.TrimSuffix(name, []byte{'\n'}))
+			continue
+		}
+
+		// Skip if not a LUKS device
+		format := dmTypeFormat(typ)
+		if format == 0 {
 			continue
 		}
 
 		cd := Cryptdevice{
-			dmdir: dirs[i],
-			uuid:  bytes.TrimSuffix(uuid, []byte{'\n'}),
+			Format: format,
+			dmdir:  dirs[i],
+			uuid:   bytes.TrimSuffix(uuid, []byte{'\n'}),
 		}
 
 		// Skip if suspended
@@ -65,44 +148,81 @@ func GetCryptdevices() ([]Cryptdevice, map[string]*Cryptdevice, error) {
 			continue
 		}
 
-		name, err := ioutil.ReadFile(filepath.Join(cd.dmdir, "name"))
+		name, err := ioutil.ReadFile(RootPath(filepath.Join(cd.dmdir, "name")))
 		if err != nil {
 			return nil, nil, err
 		}
 
 		cd.Name = string(bytes.TrimSuffix(name, []byte{'\n'}))
 
-		if cd.Name == rootdev {
-			if cryptdevs[0].IsRootDevice {
-				return nil, nil, fmt.Errorf(
-					"multiple root cryptdevices: %s, %s",
-					cryptdevs[0].Name,
-					cd.Name,
-				)
-			}
-			cd.IsRootDevice = true
-			cd.Keyfile = rootkey
-			cryptdevs[0] = cd
-			lastidx = 0
-		} else if j >= len(dirs) {
-			return nil, nil, errors.New("no root cryptdevice")
-		} else {
-			cryptdevs[j] = cd
-			lastidx = j
-			j++
-		}
-
-		if v, ok := cdmap[cd.Name]; ok {
+		if cd.major, cd.minor, err = readDevNumbers(cd.dmdir); err != nil {
+			return nil, nil, err
+		}
+
+		if key, ok := bootdevs[cd.Name]; ok {
+			cd.IsBootDevice = true
+			cd.Keyfile = key
+			hasBootDevice = true
+		}
+
+		cryptdevs = append(cryptdevs, cd)
+	}
+
+	if len(cryptdevs) > 0 && !hasBootDevice {
+		return nil, nil, errors.New("no root cryptdevice")
+	}
+
+	for i := range cryptdevs {
+		if cryptdevs[i].Format != LUKS2 {
+			continue
+		}
+		_, id := parseDMUUID(cryptdevs[i].uuid)
+		if name, ok := subdevs[id]; ok && name == cryptdevs[i].Name+integritySuffix {
+			cryptdevs[i].Integrity = name
+		}
+	}
+
+	if err := addDependencies(cryptdevs); err != nil {
+		return nil, nil, err
+	}
+
+	// Refuse layouts that cannot be suspended in any order
+	if _, err := dependencyLevels(cryptdevs); err != nil {
+		return nil, nil, err
+	}
+
+	markBootDependencies(cryptdevs)
+
+	cdmap := make(map[string]*Cryptdevice, len(cryptdevs))
+	for i := range cryptdevs {
+		if v, ok := cdmap[cryptdevs[i].Name]; ok {
 			return nil, nil, fmt.Errorf("duplicate cryptdevice: %#v", v)
 		}
-		cdmap[cd.Name] = &cryptdevs[lastidx]
+		cdmap[cryptdevs[i].Name] = &cryptdevs[i]
 	}
 
-	return cryptdevs[:j], cdmap, nil
+	return cryptdevs, cdmap, nil
+}
+
+// markBootDependencies marks the cryptdevices that boot devices are stacked
+// upon as boot devices themselves.
+func markBootDependencies(cryptdevs []Cryptdevice) {
+	for i := range cryptdevs {
+		if !cryptdevs[i].IsBootDevice {
+			continue
+		}
+		deps, err := Dependencies(cryptdevs, i)
+		if err != nil {
+			continue // Reported by GetCryptdevices
+		}
+		for _, j := range deps {
+			cryptdevs[j].IsBootDevice = true
+		}
+	}
 }
 
 func (cd *Cryptdevice) Exists() bool {
-	uuid, err := ioutil.ReadFile(filepath.Join(cd.dmdir, "uuid"))
+	uuid, err := ioutil.ReadFile(RootPath(filepath.Join(cd.dmdir, "uuid")))
 	if err != nil {
 		// A read error implies this device has been removed
 		return false
@@ -112,7 +232,7 @@ func (cd *Cryptdevice) Exists() bool {
 }
 
 func (cd *Cryptdevice) Suspended() bool {
-	buf, err := ioutil.ReadFile(filepath.Join(cd.dmdir, "suspended"))
+	buf, err := ioutil.ReadFile(RootPath(filepath.Join(cd.dmdir, "suspended")))
 	if err != nil || len(buf) == 0 {
 		// Ignore the error here for a cleaner API; read errors imply
 		// that the device is gone, so technically, it's not suspended
@@ -122,97 +242,83 @@ func (cd *Cryptdevice) Suspended() bool {
 	return buf[0] == '1'
 }
 
-func (cd *Cryptdevice) ResumeYubikey(stdin io.Reader) error {
-	//read string from console
-	reader := bufio.NewReader(os.Stdin)
-	passphrase, _ := reader.ReadString('\n')
-	passphrase = strings.Trim(passphrase, "\n")
-
-	//calc sha256
-	hash := sha256.New()
-	hash.Write([]byte(passphrase))
-	sha256Str := hex.EncodeToString(hash.Sum(nil))
-
-	//read response from yubikey
-	chalResp := exec.Command("/usr/bin/ykchalresp", "-1", sha256Str)
-	var outputBuf bytes.Buffer
-	chalResp.Stdout = &outputBuf
-	Run(chalResp)
-	chalRespStr := outputBuf.String()
-
-	var keyBuffer bytes.Buffer
-	keyBuffer.WriteString(sha256Str)
-	keyBuffer.WriteString(chalRespStr)
-
-	cmd := exec.Command("/usr/bin/cryptsetup", "--tries=1", "luksResume", cd.Name)
-	stdin1, _ := cmd.StdinPipe()
-	//cmd.Stdin = stdin1
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	stdin1.Write([]byte(keyBuffer.String()))
-
-	return Run(cmd)
+// resumeArgs returns the arguments for a luksResume of cd, restricting
+// cryptsetup to the header format cd was discovered with.
+func (cd *Cryptdevice) resumeArgs(opts ...string) []string {
+	args := make([]string, 0, len(opts)+4)
+	args = append(args, opts...)
+	if cd.Format != 0 {
+		args = append(args, "--type", cd.Format.String())
+	}
+	return append(args, "luksResume", cd.Name)
+}
+
+func (cd *Cryptdevice) Suspend() error {
+	return Cryptsetup("luksSuspend", cd.Name)
 }
 
 func (cd *Cryptdevice) Resume(stdin io.Reader) error {
-	cmd := exec.Command("/usr/bin/cryptsetup", "--tries=1", "luksResume", cd.Name)
-	cmd.Stdin = stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return Run(cmd)
+	return cryptsetupWithStdin(stdin, cd.resumeArgs("--tries=1")...)
 }
 
 var errNoKeyfile = errors.New("no keyfile")
+var errNoSharedSecret = errors.New("no shared secret")
 
 const keyfileMountDir = "/go-luks-suspend-mnt"
 
 func (cd *Cryptdevice) ResumeWithKeyfile() (err error) {
-	args := make([]string, 0, 12)
+	args := make([]string, 0, 10)
 
 	if cd.Keyfile.needsMount() {
-		if err = os.Mkdir(keyfileMountDir, 0700); err != nil {
+		if err = Mkdir(keyfileMountDir, 0700); err != nil {
 			return err
 		}
 		defer func() {
-			err = errutil.First(err, os.Remove(keyfileMountDir))
+			err = errutil.First(err, Remove(keyfileMountDir))
 		}()
 
-		if err = syscall.Mount(cd.Keyfile.Device, keyfileMountDir, cd.Keyfile.FSType, syscall.MS_RDONLY, ""); err != nil {
+		if err = mountReadOnly(cd.Keyfile.Device, keyfileMountDir, cd.Keyfile.FSType); err != nil {
 			return err
 		}
 		defer func() {
-			err = errutil.First(err, syscall.Unmount(keyfileMountDir, 0))
+			err = errutil.First(err, Unmount(keyfileMountDir, 0))
 		}()
 
 		args = append(args, "--key-file", filepath.Join(keyfileMountDir, cd.Keyfile.Path))
+	} else if cd.Keyfile.Loaded() {
+		args = append(args, "--key-file", "-")
 	} else {
 		args = append(args, "--key-file", cd.Keyfile.Path)
-		if cd.Keyfile.Offset > 0 {
-			args = append(args, "--keyfile-offset", strconv.FormatUint(cd.Keyfile.Offset, 10))
-		}
-		if cd.Keyfile.Size > 0 {
-			args = append(args, "--keyfile-size", strconv.FormatUint(cd.Keyfile.Size, 10))
-		}
-		if cd.Keyfile.KeySlotDefined() {
-			args = append(args, "--key-slot", strconv.FormatUint(cd.Keyfile.GetKeySlot(), 10))
-		}
-		if len(cd.Keyfile.Header) > 0 {
-			args = append(args, "--header", cd.Keyfile.Header)
-		}
 	}
 
-	args = append(args, "luksResume", cd.Name)
+	if cd.Keyfile.Offset > 0 {
+		args = append(args, "--keyfile-offset", strconv.FormatUint(cd.Keyfile.Offset, 10))
+	}
+	if cd.Keyfile.Size > 0 {
+		args = append(args, "--keyfile-size", strconv.FormatUint(cd.Keyfile.Size, 10))
+	}
+	if cd.Keyfile.KeySlotDefined() {
+		args = append(args, "--key-slot", strconv.FormatUint(cd.Keyfile.GetKeySlot(), 10))
+	}
+	if len(cd.Keyfile.Header) > 0 {
+		args = append(args, "--header", cd.Keyfile.Header)
+	}
 
-	return Cryptsetup(args...)
+	if cd.Keyfile.Loaded() && !cd.Keyfile.needsMount() {
+		return cryptsetupWithStdin(bytes.NewReader(cd.Keyfile.data), cd.resumeArgs(args...)...)
+	}
+	return Cryptsetup(cd.resumeArgs(args...)...)
 }
 
 // This is a variable to facilitate testing.
 var kernelCmdline = "/proc/cmdline"
 
-func parseKernelCmdline() (rootdev string, key Keyfile, err error) {
-	buf, err := ioutil.ReadFile(kernelCmdline)
+// parseKernelCmdline returns the cryptdevices that are unlocked in the
+// initramfs, and their keyfiles.
+func parseKernelCmdline() (bootdevs map[string]Keyfile, err error) {
+	buf, err := ioutil.ReadFile(RootPath(kernelCmdline))
 	if err != nil {
-		return "", Keyfile{}, err
+		return nil, err
 	}
 
 	//
@@ -220,6 +326,9 @@ func parseKernelCmdline() (rootdev string, key Keyfile, err error) {
 	//
 
 	params := strings.Fields(string(buf))
+	sd := newSDEncryptParams()
+	rootdev := ""
+	key := Keyfile{}
 
 	for i := range params {
 		kv := strings.SplitN(params[i], "=", 2)
@@ -227,6 +336,8 @@ func parseKernelCmdline() (rootdev string, key Keyfile, err error) {
 			continue
 		}
 
+		sd.parse(kv[0], kv[1])
+
 		switch kv[0] {
 		case "cryptdevice":
 			// cryptdevice=device:dmname:options
@@ -271,11 +382,47 @@ func parseKernelCmdline() (rootdev string, key Keyfile, err error) {
 		}
 	}
 
-	if len(rootdev) == 0 {
-		return "", Keyfile{}, errors.New("no root cryptdevice")
+	// The encrypt hook only unlocks a single device
+	if len(rootdev) > 0 {
+		return map[string]Keyfile{rootdev: key}, nil
 	}
 
-	return rootdev, key, nil
+	// Fall back to the parameters of the sd-encrypt hook, which unlocks
+	// every device it is told about
+	if sd.crypttab {
+		if err := sd.addCrypttab(RootPath(initramfsCrypttab)); err != nil {
+			return nil, err
+		}
+	}
+
+	devs := sd.resolve()
+	if len(devs) == 0 {
+		return nil, errors.New("no root cryptdevice")
+	}
+
+	bootdevs = make(map[string]Keyfile, len(devs))
+	for i := range devs {
+		bootdevs[devs[i].name] = devs[i].key
+	}
+
+	return bootdevs, nil
+}
+
+// BootDeviceNames returns the names of the cryptdevices that the kernel
+// command line instructs the initramfs to unlock.
+func BootDeviceNames() ([]string, error) {
+	bootdevs, err := parseKernelCmdline()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(bootdevs))
+	for name := range bootdevs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
 }
 
 func resolveDevice(name string) string {
@@ -295,8 +442,23 @@ func resolveDevice(name string) string {
 
 var ignoreLinePattern = regexp.MustCompile(`\A\s*\z|\A\s*#`)
 
-func AddKeyfilesFromCrypttab(cdmap map[string]*Cryptdevice) error {
-	file, err := os.Open("/etc/crypttab")
+// crypttabOption reports whether the options field of a crypttab line
+// contains opt.
+func crypttabOption(line, opt string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return false
+	}
+	for _, o := range strings.Split(fields[3], ",") {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+func readCrypttab(f func(line string)) error {
+	file, err := os.Open(RootPath("/etc/crypttab"))
 	if err != nil {
 		return err
 	}
@@ -308,16 +470,147 @@ func AddKeyfilesFromCrypttab(cdmap map[string]*Cryptdevice) error {
 		if ignoreLinePattern.Match(line) {
 			continue
 		}
+		f(string(line))
+	}
 
-		name, key := parseCrypttabEntry(string(line))
+	return file.Close()
+}
+
+func AddKeyfilesFromCrypttab(cdmap map[string]*Cryptdevice) error {
+	return readCrypttab(func(line string) {
+		name, key := parseCrypttabEntry(line)
 		if len(name) == 0 {
-			continue
+			return
 		}
 
 		if cd, ok := cdmap[name]; ok {
 			cd.Keyfile = key
 		}
+	})
+}
+
+// crypttabOptionValue returns the value of the option key=value in the
+// options field of a crypttab line.
+func crypttabOptionValue(line, key string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return "", false
 	}
+	for _, o := range strings.Split(fields[3], ",") {
+		if kv := strings.SplitN(o, "=", 2); len(kv) == 2 && kv[0] == key {
+			return kv[1], true
+		}
+	}
+	return "", false
+}
 
-	return file.Close()
+// AddCrypttabOptions applies the options in /etc/crypttab that affect how
+// cryptdevices are unlocked on wake:
+//
+//	x-initrd.attach              Mark the device as a boot device. Its
+//	                             keyfile is recorded unless a keyfile has
+//	                             been specified on the kernel command line.
+//	x-go-luks-suspend.unlock=    Colon separated list of unlockers to attempt
+//	                             in order, e.g. yubikey:passphrase
+//	x-go-luks-suspend.yubikey-slot=
+//	                             YubiKey challenge-response slot, 1 or 2
+//	x-go-luks-suspend.yubikey-hash=
+//	                             sha256 to hash the passphrase into the
+//	                             challenge, or none to send it as is
+//	x-go-luks-suspend.policy=    suspend, close-if-unused, unmount-and-close,
+//	                             or ignore; see DevicePolicy
+//
+// A keyfile that lives on a cryptdevice becomes a dependency of the boot
+// device it unlocks.
+func AddCrypttabOptions(cryptdevs []Cryptdevice, cdmap map[string]*Cryptdevice) error {
+	var optErr error
+
+	err := readCrypttab(func(line string) {
+		fields := strings.Fields(line)
+		cd, ok := cdmap[fields[0]]
+		if !ok {
+			return
+		}
+
+		if v, ok := crypttabOptionValue(line, "x-go-luks-suspend.unlock"); ok {
+			names, err := parseUnlockerNames(v)
+			if err != nil {
+				optErr = errutil.First(optErr, fmt.Errorf("/etc/crypttab: %s: %s", cd.Name, err.Error()))
+			}
+			cd.UnlockWith = names
+		}
+
+		if v, ok := crypttabOptionValue(line, "x-go-luks-suspend.yubikey-slot"); ok {
+			slot, err := parseYubikeySlot(v)
+			if err != nil {
+				optErr = errutil.First(optErr, fmt.Errorf("/etc/crypttab: %s: %s", cd.Name, err.Error()))
+			}
+			cd.Yubikey.Slot = slot
+		}
+
+		if v, ok := crypttabOptionValue(line, "x-go-luks-suspend.yubikey-hash"); ok {
+			hash, err := parseYubikeyHash(v)
+			if err != nil {
+				optErr = errutil.First(optErr, fmt.Errorf("/etc/crypttab: %s: %s", cd.Name, err.Error()))
+			}
+			cd.Yubikey.Hash = hash
+		}
+
+		if v, ok := crypttabOptionValue(line, "x-go-luks-suspend.policy"); ok {
+			policy, err := parseDevicePolicy(v)
+			if err != nil {
+				optErr = errutil.First(optErr, fmt.Errorf("/etc/crypttab: %s: %s", cd.Name, err.Error()))
+			}
+			cd.Policy = policy
+		}
+
+		if !crypttabOption(line, "x-initrd.attach") {
+			return
+		}
+
+		cd.IsBootDevice = true
+
+		if _, key := parseCrypttabEntry(line); key.Defined() && !cd.Keyfile.Defined() {
+			cd.Keyfile = key
+		}
+	})
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if optErr != nil {
+		return optErr
+	}
+
+	for i := range cryptdevs {
+		cd := &cryptdevs[i]
+		if !cd.IsBootDevice || !cd.Keyfile.Defined() || cd.Keyfile.needsMount() {
+			continue
+		}
+		block, ok := fileBlockDevice(cd.Keyfile.Path)
+		if !ok {
+			continue
+		}
+		deps, err := cryptdevicesBeneath(cryptdevs, block, true)
+		if err != nil {
+			return err
+		}
+		for _, name := range deps {
+			// A keyfile on the device it unlocks, like /crypto_keyfile.bin
+			// on cryptroot, is read from the initramfs, and one on a device
+			// stacked upon it could never be read
+			if name == cd.Name || dependsUpon(cryptdevs, name, cd.Name) {
+				continue
+			}
+			cd.DependsOn = append(cd.DependsOn, name)
+		}
+	}
+
+	if _, err := dependencyLevels(cryptdevs); err != nil {
+		return err
+	}
+
+	markBootDependencies(cryptdevs)
+
+	return validateDevicePolicies(cryptdevs)
 }
@@ -4,52 +4,97 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"testing"
 )
 
 func TestKernelCmdlineParsing(t *testing.T) {
 	kernelCmdlineSave := kernelCmdline
+	initramfsCrypttabSave := initramfsCrypttab
 	kernelCmdline = "test_kernel_cmdline"
+	initramfsCrypttab = "test_crypttab_initramfs"
 	defer func() {
-		_ = os.Remove(kernelCmdline) // errcheck: rm -f
+		_ = os.Remove(kernelCmdline)     // errcheck: rm -f
+		_ = os.Remove(initramfsCrypttab) // errcheck: rm -f
 		kernelCmdline = kernelCmdlineSave
+		initramfsCrypttab = initramfsCrypttabSave
 	}()
 
 	data := []struct {
-		in, name string
-		key      Keyfile
-		err      error
+		in, crypttab string
+		bootdevs     map[string]Keyfile
+		err          error
 	}{
 		// cryptdevice=
 		{
-			in:   "cryptdevice=UUID=d55cc35b-e99b-44ce-be89-4c573fccfb0b:cryptroot root=/dev/mapper/cryptroot\n",
-			name: "cryptroot",
+			in:       "cryptdevice=UUID=d55cc35b-e99b-44ce-be89-4c573fccfb0b:cryptroot root=/dev/mapper/cryptroot\n",
+			bootdevs: map[string]Keyfile{"cryptroot": {}},
 		},
 		{
-			in:   "cryptdevice=/dev/sda1:cryptroot1 cryptdevice=/dev/sda2:cryptroot2\n",
-			name: "cryptroot2",
+			in:       "cryptdevice=/dev/sda1:cryptroot1 cryptdevice=/dev/sda2:cryptroot2\n",
+			bootdevs: map[string]Keyfile{"cryptroot2": {}},
 		},
 		{
-			in:   "cryptdevice=UUID=cd5dd4dc-5766-493e-b3c6-3d6dfd195082:cryptolvm:allow-discards root=/dev/mapper/system-root",
-			name: "cryptolvm",
+			in:       "cryptdevice=UUID=cd5dd4dc-5766-493e-b3c6-3d6dfd195082:cryptolvm:allow-discards root=/dev/mapper/system-root",
+			bootdevs: map[string]Keyfile{"cryptolvm": {}},
 		},
 		// cryptkey=
 		{
-			in:   "cryptdevice=/dev/sda2:root cryptkey=rootfs:/var/rootfs.key\n",
-			name: "root",
-			key:  Keyfile{Path: "/var/rootfs.key"},
+			in:       "cryptdevice=/dev/sda2:root cryptkey=rootfs:/var/rootfs.key\n",
+			bootdevs: map[string]Keyfile{"root": {Path: "/var/rootfs.key"}},
 		},
 		{
-			in:   "cryptdevice=/dev/sda2:root cryptkey=/dev/sdb:512:1024\n",
-			name: "root",
-			key:  Keyfile{Path: "/dev/sdb", Offset: 512, Size: 1024},
+			in:       "cryptdevice=/dev/sda2:root cryptkey=/dev/sdb:512:1024\n",
+			bootdevs: map[string]Keyfile{"root": {Path: "/dev/sdb", Offset: 512, Size: 1024}},
+		},
+		// rd.luks.*
+		{
+			in:       "rd.luks.uuid=d55cc35b-e99b-44ce-be89-4c573fccfb0b root=/dev/mapper/luks-d55cc35b-e99b-44ce-be89-4c573fccfb0b\n",
+			bootdevs: map[string]Keyfile{"luks-d55cc35b-e99b-44ce-be89-4c573fccfb0b": {}},
+		},
+		{
+			in:       "rd.luks.name=D55CC35B-E99B-44CE-BE89-4C573FCCFB0B=cryptroot root=/dev/mapper/cryptroot rw\n",
+			bootdevs: map[string]Keyfile{"cryptroot": {}},
+		},
+		{
+			in:       "rd.luks.name=d55cc35b-e99b-44ce-be89-4c573fccfb0b=cryptdata rd.luks.name=cd5dd4dc-5766-493e-b3c6-3d6dfd195082=cryptroot root=/dev/mapper/cryptroot\n",
+			bootdevs: map[string]Keyfile{"cryptdata": {}, "cryptroot": {}},
+		},
+		{
+			in:       "rd.luks.name=d55cc35b-e99b-44ce-be89-4c573fccfb0b=cryptbtrfs1 rd.luks.name=cd5dd4dc-5766-493e-b3c6-3d6dfd195082=cryptbtrfs2 rd.luks.key=cd5dd4dc-5766-493e-b3c6-3d6dfd195082=/crypto_keyfile.bin\n",
+			bootdevs: map[string]Keyfile{"cryptbtrfs1": {}, "cryptbtrfs2": {Path: "/crypto_keyfile.bin"}},
+		},
+		{
+			in:       "rd.luks.name=d55cc35b-e99b-44ce-be89-4c573fccfb0b=cryptroot rd.luks.key=/crypto_keyfile.bin rd.luks.options=keyfile-offset=512,discard\n",
+			bootdevs: map[string]Keyfile{"cryptroot": {Path: "/crypto_keyfile.bin", Offset: 512}},
+		},
+		{
+			in:       "rd.luks.name=d55cc35b-e99b-44ce-be89-4c573fccfb0b=cryptroot rd.luks.key=d55cc35b-e99b-44ce-be89-4c573fccfb0b=/keys/root.key:LABEL=usbkey rd.luks.options=d55cc35b-e99b-44ce-be89-4c573fccfb0b=key-slot=1\n",
+			bootdevs: map[string]Keyfile{"cryptroot": {Path: "/keys/root.key", Device: "/dev/disk/by-label/usbkey", FSType: "auto", KeySlot: 0x81}},
+		},
+		{
+			in:       "rw quiet\n",
+			crypttab: "# <name> <device> <keyfile> <options>\ncryptroot UUID=d55cc35b-e99b-44ce-be89-4c573fccfb0b /crypto_keyfile.bin luks,keyfile-size=64\n",
+			bootdevs: map[string]Keyfile{"cryptroot": {Path: "/crypto_keyfile.bin", Size: 64}},
+		},
+		{
+			in:       "rd.luks.uuid=d55cc35b-e99b-44ce-be89-4c573fccfb0b\n",
+			crypttab: "cryptroot UUID=d55cc35b-e99b-44ce-be89-4c573fccfb0b none\n",
+			bootdevs: map[string]Keyfile{"cryptroot": {}},
+		},
+		{
+			in:       "rd.luks.crypttab=no\n",
+			crypttab: "cryptroot UUID=d55cc35b-e99b-44ce-be89-4c573fccfb0b none\n",
+			err:      errors.New("no root cryptdevice"),
+		},
+		{
+			in:  "rd.luks=0 rd.luks.uuid=d55cc35b-e99b-44ce-be89-4c573fccfb0b\n",
+			err: errors.New("no root cryptdevice"),
 		},
 		// errors
 		{
-			in:   "BOOT_IMAGE=../vmlinuz-linux rw initrd=../initramfs-linux.img\n",
-			name: "",
-			key:  Keyfile{},
-			err:  errors.New("no root cryptdevice"),
+			in:  "BOOT_IMAGE=../vmlinuz-linux rw initrd=../initramfs-linux.img\n",
+			err: errors.New("no root cryptdevice"),
 		},
 	}
 
@@ -59,15 +104,64 @@ func TestKernelCmdlineParsing(t *testing.T) {
 			t.Errorf("unexpected error: %#v", err)
 		}
 
-		name, key, err := parseKernelCmdline()
-		if name != row.name {
-			t.Errorf("%#v != %#v", name, row.name)
+		_ = os.Remove(initramfsCrypttab) // errcheck: rm -f
+		if len(row.crypttab) > 0 {
+			err = ioutil.WriteFile(initramfsCrypttab, []byte(row.crypttab), 0644)
+			if err != nil {
+				t.Errorf("unexpected error: %#v", err)
+			}
 		}
-		if key != row.key {
-			t.Errorf("%#v != %#v", name, row.key)
+
+		bootdevs, err := parseKernelCmdline()
+		if !reflect.DeepEqual(bootdevs, row.bootdevs) {
+			t.Errorf("%#v != %#v", bootdevs, row.bootdevs)
 		}
 		if (err == nil) != (row.err == nil) {
 			t.Errorf("%#v !~ %#v", err, row.err)
 		}
 	}
 }
+
+func TestParseDMUUID(t *testing.T) {
+	data := []struct {
+		in      string
+		typ, id string
+		format  LUKSFormat
+	}{
+		{
+			in:     "CRYPT-LUKS1-d55cc35be99b44cebe894c573fccfb0b-cryptroot\n",
+			typ:    "LUKS1",
+			id:     "d55cc35be99b44cebe894c573fccfb0b",
+			format: LUKS1,
+		},
+		{
+			in:     "CRYPT-LUKS2-cd5dd4dc5766493eb3c63d6dfd195082-crypt-data\n",
+			typ:    "LUKS2",
+			id:     "cd5dd4dc5766493eb3c63d6dfd195082",
+			format: LUKS2,
+		},
+		{
+			in:  "CRYPT-SUBDEV-cd5dd4dc5766493eb3c63d6dfd195082-crypt-data_dif\n",
+			typ: "SUBDEV",
+			id:  "cd5dd4dc5766493eb3c63d6dfd195082",
+		},
+		{
+			in:  "CRYPT-PLAIN-cryptswap\n",
+			typ: "PLAIN",
+			id:  "cryptswap",
+		},
+		{in: "LVM-JYvlNB4mKQWlmfmgKhZqVd5TRBU2C2dxyQjDcs5B8B1ugRpcgNYNn2PVFAvNgHpC\n"},
+		{in: "CRYPT-LUKS2"},
+		{in: ""},
+	}
+
+	for _, row := range data {
+		typ, id := parseDMUUID([]byte(row.in))
+		if typ != row.typ || id != row.id {
+			t.Errorf("%#v, %#v != %#v, %#v", typ, id, row.typ, row.id)
+		}
+		if f := dmTypeFormat(typ); f != row.format {
+			t.Errorf("%v != %v", f, row.format)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package goLuksSuspend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//
+// Cryptdevice policies
+//
+// Suspending a cryptdevice keeps its key out of RAM only until it is
+// resumed, and a device that is not resumed on wake lingers after its
+// drive is unplugged. A cryptdevice that nothing needs, such as an
+// unmounted backup drive, is better closed before suspending, after which
+// there is nothing to resume.
+//
+
+// A DevicePolicy decides what happens to a cryptdevice before suspend.
+type DevicePolicy string
+
+const (
+	// luksSuspend the device, and resume it on wake
+	DevicePolicySuspend DevicePolicy = "suspend"
+	// luksClose the device if no filesystem, swap area, or block device
+	// is built upon it, and suspend it otherwise
+	DevicePolicyCloseIfUnused DevicePolicy = "close-if-unused"
+	// Unmount the filesystems and disable the swap areas built upon the
+	// device, then luksClose it
+	DevicePolicyUnmountAndClose DevicePolicy = "unmount-and-close"
+	// Leave the device unlocked
+	DevicePolicyIgnore DevicePolicy = "ignore"
+)
+
+var devicePolicies = []DevicePolicy{
+	DevicePolicySuspend,
+	DevicePolicyCloseIfUnused,
+	DevicePolicyUnmountAndClose,
+	DevicePolicyIgnore,
+}
+
+func parseDevicePolicy(s string) (DevicePolicy, error) {
+	for _, p := range devicePolicies {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+
+	names := make([]string, len(devicePolicies))
+	for i := range devicePolicies {
+		names[i] = string(devicePolicies[i])
+	}
+
+	return "", fmt.Errorf("unknown policy %#v; expected one of %s", s, strings.Join(names, ", "))
+}
+
+// validateDevicePolicies refuses to close or ignore boot devices, which
+// the initramfs must lock and unlock.
+func validateDevicePolicies(cryptdevs []Cryptdevice) error {
+	for i := range cryptdevs {
+		cd := &cryptdevs[i]
+		if cd.IsBootDevice && cd.Policy != "" && cd.Policy != DevicePolicySuspend {
+			return fmt.Errorf("%s: boot devices can only be suspended, not %s", cd.Name, cd.Policy)
+		}
+	}
+	return nil
+}
+
+// A Closure is a cryptdevice that is closed instead of suspended.
+type Closure struct {
+	Name string
+	// Filesystems and swap areas to release before closing, in order
+	Release []Dependent
+}
+
+// PlanDevicePolicies splits cryptdevs into the cryptdevices to suspend and
+// those to close, given the filesystems and swap areas built upon them.
+// Closures are ordered so that each cryptdevice is closed before those it
+// is built upon. A cryptdevice that cannot be closed because a block
+// device other than a closed cryptdevice is built upon it, like an LVM
+// volume, is suspended instead, and a warning is returned for it.
+func PlanDevicePolicies(cryptdevs []Cryptdevice, deps []Dependent) (suspend []Cryptdevice, closures []Closure, warnings []string, err error) {
+	closing := map[string]bool{}
+	policies := make(map[string]DevicePolicy, len(cryptdevs))
+	for i := range cryptdevs {
+		policies[cryptdevs[i].Name] = cryptdevs[i].Policy
+		switch cryptdevs[i].Policy {
+		case DevicePolicyCloseIfUnused, DevicePolicyUnmountAndClose:
+			closing[cryptdevs[i].Name] = true
+		}
+	}
+
+	byBlock := make(map[string]string, len(cryptdevs))
+	for i := range cryptdevs {
+		byBlock[cryptdevs[i].blockName()] = cryptdevs[i].Name
+	}
+
+	holders := map[string][]string{}
+	for i := range cryptdevs {
+		if !closing[cryptdevs[i].Name] {
+			continue
+		}
+		if holders[cryptdevs[i].Name], err = cryptdevs[i].holders(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	// Closing one cryptdevice may depend on closing another, so drop
+	// candidates until none is blocked
+	for changed := true; changed; {
+		changed = false
+
+		for i := range cryptdevs {
+			cd := &cryptdevs[i]
+			if !closing[cd.Name] {
+				continue
+			}
+
+			reason := ""
+			for _, h := range holders[cd.Name] {
+				if name, ok := byBlock[h]; !ok || !closing[name] {
+					reason = h + " is built upon it"
+					break
+				}
+			}
+
+			if len(reason) == 0 && cd.Policy == DevicePolicyCloseIfUnused {
+				for _, d := range deps {
+					if contains(d.Cryptdevices, cd.Name) && !isReleased(d, closing, policies) {
+						reason = fmt.Sprintf("%s %s is in use", d.Kind, d.Path)
+						break
+					}
+				}
+			}
+
+			if len(reason) > 0 {
+				closing[cd.Name] = false
+				changed = true
+				if cd.Policy == DevicePolicyUnmountAndClose {
+					warnings = append(warnings, fmt.Sprintf("cannot close %s: %s; suspending it instead", cd.Name, reason))
+				}
+			}
+		}
+	}
+
+	order, err := SuspendOrder(cryptdevs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	released := map[int]bool{}
+	for _, i := range order {
+		name := cryptdevs[i].Name
+		if !closing[name] {
+			continue
+		}
+		c := Closure{Name: name}
+		// Later mounts may be mounted upon earlier ones
+		for j := len(deps) - 1; j >= 0; j-- {
+			if !released[j] && contains(deps[j].Cryptdevices, name) && isReleased(deps[j], closing, policies) {
+				released[j] = true
+				c.Release = append(c.Release, deps[j])
+			}
+		}
+		closures = append(closures, c)
+	}
+
+	for i := range cryptdevs {
+		if !closing[cryptdevs[i].Name] && cryptdevs[i].Policy != DevicePolicyIgnore {
+			suspend = append(suspend, cryptdevs[i])
+		}
+	}
+
+	return suspend, closures, warnings, nil
+}
+
+// isReleased reports whether d is built upon a cryptdevice that is
+// unmounted and closed.
+func isReleased(d Dependent, closing map[string]bool, policies map[string]DevicePolicy) bool {
+	for _, name := range d.Cryptdevices {
+		if closing[name] && policies[name] == DevicePolicyUnmountAndClose {
+			return true
+		}
+	}
+	return false
+}
+
+// holders returns the kernel names of the block devices built directly
+// upon cd.
+func (cd *Cryptdevice) holders() ([]string, error) {
+	fs, err := ioutil.ReadDir(RootPath(filepath.Join(sysClassBlock, cd.blockName(), "holders")))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(fs))
+	for i := range fs {
+		names[i] = fs[i].Name()
+	}
+
+	return names, nil
+}
+
+// Close is luksClose of cd. Nothing built upon cd may remain.
+func (cd *Cryptdevice) Close() error {
+	return Cryptsetup("luksClose", cd.Name)
+}
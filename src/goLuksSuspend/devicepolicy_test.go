@@ -0,0 +1,138 @@
+package goLuksSuspend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanDevicePolicies(t *testing.T) {
+	root := SimulatedDevice{Name: "cryptroot", Boot: true}
+	fs := func(mountpoint string, devices ...string) SimulatedFilesystem {
+		return SimulatedFilesystem{Mountpoint: mountpoint, Type: "ext4", Devices: devices}
+	}
+
+	type closure struct {
+		Name    string
+		Release []string
+	}
+
+	data := []struct {
+		devices     []SimulatedDevice
+		filesystems []SimulatedFilesystem
+		suspend     []string
+		closures    []closure
+		warnings    int
+	}{
+		// An unmounted backup drive is closed
+		{
+			devices:  []SimulatedDevice{root, {Name: "cryptbackup", Policy: "close-if-unused"}},
+			suspend:  []string{"cryptroot"},
+			closures: []closure{{"cryptbackup", nil}},
+		},
+		// A mounted one is suspended
+		{
+			devices:     []SimulatedDevice{root, {Name: "cryptbackup", Policy: "close-if-unused"}},
+			filesystems: []SimulatedFilesystem{fs("/", "cryptroot"), fs("/mnt/backup", "cryptbackup")},
+			suspend:     []string{"cryptroot", "cryptbackup"},
+		},
+		// unless it may be unmounted, mounts upon it first
+		{
+			devices:     []SimulatedDevice{root, {Name: "cryptbackup", Policy: "unmount-and-close"}},
+			filesystems: []SimulatedFilesystem{fs("/mnt/backup", "cryptbackup"), fs("/mnt/backup/old", "cryptbackup")},
+			suspend:     []string{"cryptroot"},
+			closures:    []closure{{"cryptbackup", []string{"/mnt/backup/old", "/mnt/backup"}}},
+		},
+		// Unmounting the upper device frees the lower one
+		{
+			devices: []SimulatedDevice{
+				root,
+				{Name: "cryptlower", Policy: "close-if-unused"},
+				{Name: "cryptupper", DependsOn: []string{"cryptlower"}, Policy: "unmount-and-close"},
+			},
+			filesystems: []SimulatedFilesystem{fs("/srv", "cryptlower", "cryptupper")},
+			suspend:     []string{"cryptroot"},
+			closures:    []closure{{"cryptupper", []string{"/srv"}}, {"cryptlower", nil}},
+		},
+		// A suspended device upon the lower one keeps it open
+		{
+			devices: []SimulatedDevice{
+				root,
+				{Name: "cryptlower", Policy: "unmount-and-close"},
+				{Name: "cryptupper", DependsOn: []string{"cryptlower"}},
+			},
+			filesystems: []SimulatedFilesystem{fs("/srv", "cryptlower", "cryptupper")},
+			suspend:     []string{"cryptroot", "cryptlower", "cryptupper"},
+			warnings:    1,
+		},
+		// Ignored devices are neither suspended nor closed
+		{
+			devices:     []SimulatedDevice{root, {Name: "cryptscratch", Policy: "ignore"}},
+			filesystems: []SimulatedFilesystem{fs("/scratch", "cryptscratch")},
+			suspend:     []string{"cryptroot"},
+		},
+	}
+
+	for _, row := range data {
+		var (
+			suspend  []Cryptdevice
+			closures []Closure
+			warnings []string
+		)
+
+		simulate(t, &Simulation{Devices: row.devices, Filesystems: row.filesystems}, func() {
+			cryptdevs, cdmap, err := GetCryptdevices()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := AddCrypttabOptions(cryptdevs, cdmap); err != nil {
+				t.Fatal(err)
+			}
+			deps, err := ResolveDependents(cryptdevs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			suspend, closures, warnings, err = PlanDevicePolicies(cryptdevs, deps)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		names := []string{}
+		for i := range suspend {
+			names = append(names, suspend[i].Name)
+		}
+		var got []closure
+		for _, c := range closures {
+			var paths []string
+			for _, d := range c.Release {
+				paths = append(paths, d.Path)
+			}
+			got = append(got, closure{c.Name, paths})
+		}
+
+		if !reflect.DeepEqual(names, row.suspend) {
+			t.Errorf("%v: %#v != %#v", row.devices, names, row.suspend)
+		}
+		if !reflect.DeepEqual(got, row.closures) {
+			t.Errorf("%v: %#v != %#v", row.devices, got, row.closures)
+		}
+		if len(warnings) != row.warnings {
+			t.Errorf("%v: unexpected warnings %#v", row.devices, warnings)
+		}
+	}
+
+	// The initramfs must lock the boot devices
+	simulate(t, &Simulation{Devices: []SimulatedDevice{{Name: "cryptroot", Boot: true, Policy: "close-if-unused"}}}, func() {
+		cryptdevs, cdmap, err := GetCryptdevices()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := AddCrypttabOptions(cryptdevs, cdmap); err == nil {
+			t.Errorf("boot device with close-if-unused policy passed validation")
+		}
+	})
+	if _, err := parseDevicePolicy("close"); err == nil {
+		t.Errorf("unknown policy parsed")
+	}
+}
@@ -0,0 +1,68 @@
+package goLuksSuspend
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Errors reported by cryptsetup, distinguished by its exit status. See
+// the RETURN CODES section of cryptsetup(8).
+var (
+	ErrInvalidArguments = errors.New("wrong parameters")
+	ErrWrongPassphrase  = errors.New("no key available with this passphrase")
+	ErrOutOfMemory      = errors.New("out of memory")
+	ErrDeviceNotFound   = errors.New("device not found")
+	ErrDeviceBusy       = errors.New("device already exists or is busy")
+	ErrCommandMissing   = errors.New("command not found")
+)
+
+// A CommandError describes a failed invocation of an external program.
+type CommandError struct {
+	// Path of the program
+	Path string
+	// One of the errors above, or the error returned by Run
+	Err error
+	// Standard error of the program, without trailing whitespace
+	Stderr string
+}
+
+func (e *CommandError) Error() string {
+	msg := e.Path + ": " + e.Err.Error()
+	if len(e.Stderr) > 0 {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error { return e.Err }
+
+// cryptsetupExitErrors maps the exit status of cryptsetup to an error.
+var cryptsetupExitErrors = map[int]error{
+	1: ErrInvalidArguments,
+	2: ErrWrongPassphrase,
+	3: ErrOutOfMemory,
+	4: ErrDeviceNotFound,
+	5: ErrDeviceBusy,
+}
+
+// cryptsetupError converts the error returned by running cryptsetup into a
+// *CommandError, or returns nil if err is nil.
+func cryptsetupError(path string, err error, stderr string) error {
+	if err == nil {
+		return nil
+	}
+
+	e := &CommandError{Path: path, Err: err, Stderr: strings.TrimSpace(stderr)}
+
+	if exitErr, ok := err.(interface{ ExitCode() int }); ok {
+		if kind, ok := cryptsetupExitErrors[exitErr.ExitCode()]; ok {
+			e.Err = kind
+		}
+	} else if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		e.Err = ErrCommandMissing
+	}
+
+	return e
+}
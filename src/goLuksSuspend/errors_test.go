@@ -0,0 +1,39 @@
+package goLuksSuspend
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestCryptsetupError(t *testing.T) {
+	data := []struct {
+		cmd      *exec.Cmd
+		expected error
+	}{
+		{cmd: exec.Command("/bin/sh", "-c", "exit 2"), expected: ErrWrongPassphrase},
+		{cmd: exec.Command("/bin/sh", "-c", "exit 4"), expected: ErrDeviceNotFound},
+		{cmd: exec.Command("/bin/sh", "-c", "exit 5"), expected: ErrDeviceBusy},
+		{cmd: exec.Command("/nonexistent/cryptsetup"), expected: ErrCommandMissing},
+	}
+
+	for _, row := range data {
+		err := cryptsetupError(row.cmd.Path, row.cmd.Run(), "  message\n")
+		if !errors.Is(err, row.expected) {
+			t.Errorf("%#v: %#v is not %#v", row.cmd.Args, err, row.expected)
+		}
+		if e, ok := err.(*CommandError); !ok || e.Stderr != "message" {
+			t.Errorf("%#v: unexpected error %#v", row.cmd.Args, err)
+		}
+	}
+
+	if err := cryptsetupError("cryptsetup", exec.Command("/bin/sh", "-c", "exit 0").Run(), ""); err != nil {
+		t.Errorf("unexpected error: %#v", err)
+	}
+
+	// Unknown exit codes are left alone
+	err := cryptsetupError("cryptsetup", exec.Command("/bin/sh", "-c", "exit 42").Run(), "")
+	if _, ok := errors.Unwrap(err).(*exec.ExitError); !ok {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
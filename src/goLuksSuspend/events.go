@@ -0,0 +1,132 @@
+package goLuksSuspend
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type EventKind uint8
+
+const (
+	// A cryptdevice was suspended
+	EventSuspended EventKind = iota + 1
+	// The system is about to sleep
+	EventSleep
+	// The system woke from sleep
+	EventWake
+	// An unlocker failed to resume a cryptdevice
+	EventUnlockFailed
+	// A cryptdevice was resumed
+	EventResumed
+	// An error not tied to an unlock attempt
+	EventError
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventSuspended:
+		return "suspended"
+	case EventSleep:
+		return "sleep"
+	case EventWake:
+		return "wake"
+	case EventUnlockFailed:
+		return "unlock-failed"
+	case EventResumed:
+		return "resumed"
+	case EventError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// An Event is sent by the initramfs to go-luks-suspend to record what
+// happened while the root device was suspended.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+	// Name of the cryptdevice, if any
+	Device string
+	// Name of the unlocker, if any
+	Method string
+	// Error message, if any
+	Err string
+}
+
+func (e *Event) String() string {
+	s := e.Kind.String()
+	if len(e.Device) > 0 {
+		s += " " + e.Device
+	}
+	if len(e.Method) > 0 {
+		s += " with " + e.Method
+	}
+	if len(e.Err) > 0 {
+		s += ": " + e.Err
+	}
+	return s
+}
+
+var eventEncoder *gob.Encoder
+var eventMutex sync.Mutex
+
+// SetEventWriter directs subsequent calls to Report to w. Events are
+// discarded if w is nil.
+func SetEventWriter(w io.Writer) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+
+	if w == nil {
+		eventEncoder = nil
+	} else {
+		eventEncoder = gob.NewEncoder(w)
+	}
+}
+
+// Report sends e to the event writer. The current time is recorded if
+// e.Time is zero. Failures are logged but otherwise ignored since events
+// are informational.
+func Report(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	Debug("event: " + e.String())
+
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+
+	if eventEncoder == nil {
+		return
+	}
+
+	if err := eventEncoder.Encode(&e); err != nil {
+		Warn(fmt.Sprintf("[WARNING] unable to report event: %s", err.Error()))
+		eventEncoder = nil
+	}
+}
+
+// ReportError is a shorthand for reporting an EventError.
+func ReportError(device string, err error) {
+	Report(Event{Kind: EventError, Device: device, Err: err.Error()})
+}
+
+// ReadEvents decodes events from r until EOF.
+func ReadEvents(r io.Reader) ([]Event, error) {
+	dec := gob.NewDecoder(r)
+	events := []Event{}
+
+	for {
+		var e Event
+		if err := dec.Decode(&e); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+}
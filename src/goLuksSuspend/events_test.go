@@ -0,0 +1,41 @@
+package goLuksSuspend
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEventRoundTrip(t *testing.T) {
+	buf := bytes.Buffer{}
+	SetEventWriter(&buf)
+	defer SetEventWriter(nil)
+
+	Report(Event{Kind: EventSuspended, Device: "cryptroot"})
+	Report(Event{Kind: EventUnlockFailed, Device: "cryptroot", Method: "passphrase", Err: "wrong"})
+	ReportError("", errors.New("line one\nline two"))
+
+	events, err := ReadEvents(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"suspended cryptroot",
+		"unlock-failed cryptroot with passphrase: wrong",
+		"error: line one\nline two",
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("%d events != %d", len(events), len(expected))
+	}
+
+	for i := range events {
+		if s := events[i].String(); s != expected[i] {
+			t.Errorf("%#v != %#v", s, expected[i])
+		}
+		if events[i].Time.IsZero() {
+			t.Errorf("%#v: missing time", events[i])
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package goLuksSuspend
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// The block layer records stacking in /sys/class/block/*/slaves and the
+// inverse relation in /sys/class/block/*/holders, so walking the slaves of
+// a device visits every device it is built upon. Two relations are not
+// recorded there: partitions are children of their disk in the sysfs tree,
+// and loop devices refer to the filesystem containing their backing file.
+
+const sysClassBlock = "/sys/class/block"
+
+// blockSlaves returns the kernel names of the block devices that the block
+// device name is built upon.
+func blockSlaves(name string) ([]string, error) {
+	dir := RootPath(filepath.Join(sysClassBlock, name))
+
+	fs, err := ioutil.ReadDir(filepath.Join(dir, "slaves"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	slaves := make([]string, 0, len(fs)+1)
+	for i := range fs {
+		slaves = append(slaves, fs[i].Name())
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		path, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return nil, err
+		}
+		slaves = append(slaves, filepath.Base(filepath.Dir(path)))
+	}
+
+	backingFile, err := ioutil.ReadFile(filepath.Join(dir, "loop", "backing_file"))
+	if err == nil {
+		path := string(bytes.TrimSuffix(backingFile, []byte{'\n'}))
+		// The backing file of a loop device may have been unlinked, or
+		// may live on a filesystem without a backing block device
+		// (e.g. btrfs or tmpfs), in which case there is nothing to follow.
+		if slave, ok := fileBlockDevice(path); ok {
+			slaves = append(slaves, slave)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return slaves, nil
+}
+
+// fileBlockDevice returns the kernel name of the block device containing
+// path.
+func fileBlockDevice(path string) (string, bool) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(RootPath(path), &st); err != nil {
+		return "", false
+	}
+
+	return BlockName(fmt.Sprintf("%d:%d", devMajor(st.Dev), devMinor(st.Dev)))
+}
+
+// BlockName returns the kernel name of the block device numbered dev,
+// given as major:minor. Filesystems without a backing block device have
+// device numbers that do not name one.
+func BlockName(dev string) (string, bool) {
+	link, err := os.Readlink(RootPath("/sys/dev/block/" + dev))
+	if err != nil {
+		return "", false
+	}
+
+	return filepath.Base(link), true
+}
+
+// DeviceFileBlockName returns the kernel name of the block device file at
+// path, e.g. dm-0 for /dev/mapper/cryptroot.
+func DeviceFileBlockName(path string) (string, bool) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(RootPath(path), &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return "", false
+	}
+
+	return BlockName(fmt.Sprintf("%d:%d", devMajor(st.Rdev), devMinor(st.Rdev)))
+}
+
+// BlockStack returns the kernel names of the block device name and of every
+// block device it is built upon, starting with name itself.
+func BlockStack(name string) ([]string, error) {
+	stack := []string{name}
+	visited := map[string]bool{name: true}
+
+	for i := 0; i < len(stack); i++ {
+		slaves, err := blockSlaves(stack[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range slaves {
+			if !visited[s] {
+				visited[s] = true
+				stack = append(stack, s)
+			}
+		}
+	}
+
+	return stack, nil
+}
+
+// CryptdevicesIn returns the names of the cryptdevices whose block devices
+// are in stack.
+func CryptdevicesIn(cryptdevs []Cryptdevice, stack []string) []string {
+	names := []string{}
+
+	for i := range cryptdevs {
+		for _, name := range stack {
+			if cryptdevs[i].blockName() == name {
+				names = append(names, cryptdevs[i].Name)
+				break
+			}
+		}
+	}
+
+	return names
+}
+
+// Linux dev_t encoding; see gnu_dev_major(3) and gnu_dev_minor(3).
+func devMajor(dev uint64) uint64 {
+	return ((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff)
+}
+
+func devMinor(dev uint64) uint64 {
+	return (dev & 0xff) | ((dev >> 12) &^ 0xff)
+}
+
+func (cd *Cryptdevice) blockName() string {
+	return filepath.Base(filepath.Dir(cd.dmdir))
+}
+
+// addDependencies records the names of the cryptdevices each cryptdevice is
+// built upon, directly or through intermediate layers like LVM, md, or loop
+// devices.
+func addDependencies(cryptdevs []Cryptdevice) error {
+	for i := range cryptdevs {
+		deps, err := cryptdevicesBeneath(cryptdevs, cryptdevs[i].blockName(), false)
+		if err != nil {
+			return err
+		}
+		cryptdevs[i].DependsOn = deps
+	}
+
+	return nil
+}
+
+// cryptdevicesBeneath returns the names of the cryptdevices that the block
+// device block is built upon, stopping at the first cryptdevice on each
+// path; the rest of the stack is its own dependency. If inclusive is true,
+// block itself is returned if it is a cryptdevice.
+func cryptdevicesBeneath(cryptdevs []Cryptdevice, block string, inclusive bool) ([]string, error) {
+	byBlock := make(map[string]string, len(cryptdevs))
+	for i := range cryptdevs {
+		byBlock[cryptdevs[i].blockName()] = cryptdevs[i].Name
+	}
+
+	if name, ok := byBlock[block]; ok && inclusive {
+		return []string{name}, nil
+	}
+
+	deps := []string{}
+	visited := map[string]bool{block: true}
+	stack := []string{block}
+
+	for len(stack) > 0 {
+		name := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		slaves, err := blockSlaves(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range slaves {
+			if visited[s] {
+				continue
+			}
+			visited[s] = true
+
+			if dep, ok := byBlock[s]; ok {
+				deps = append(deps, dep)
+			} else {
+				stack = append(stack, s)
+			}
+		}
+	}
+
+	sort.Strings(deps)
+
+	return deps, nil
+}
+
+// dependencyLevels partitions the indices of cryptdevs into levels such that
+// every cryptdevice depends only on cryptdevices in earlier levels.
+// Dependencies on devices not in cryptdevs are ignored.
+func dependencyLevels(cryptdevs []Cryptdevice) ([][]int, error) {
+	index := make(map[string]int, len(cryptdevs))
+	for i := range cryptdevs {
+		index[cryptdevs[i].Name] = i
+	}
+
+	placed := make([]bool, len(cryptdevs))
+	levels := [][]int{}
+	remaining := len(cryptdevs)
+
+	for remaining > 0 {
+		level := []int{}
+
+	outer:
+		for i := range cryptdevs {
+			if placed[i] {
+				continue
+			}
+			for _, dep := range cryptdevs[i].DependsOn {
+				if j, ok := index[dep]; ok && !placed[j] {
+					continue outer
+				}
+			}
+			level = append(level, i)
+		}
+
+		if len(level) == 0 {
+			names := []string{}
+			for i := range cryptdevs {
+				if !placed[i] {
+					names = append(names, cryptdevs[i].Name)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle among cryptdevices: %s", strings.Join(names, ", "))
+		}
+
+		for _, i := range level {
+			placed[i] = true
+		}
+		remaining -= len(level)
+		levels = append(levels, level)
+	}
+
+	return levels, nil
+}
+
+// ResumeLevels groups the indices of cryptdevs into levels that must be
+// resumed in order. The cryptdevices within a level do not depend on each
+// other.
+func ResumeLevels(cryptdevs []Cryptdevice) ([][]int, error) {
+	return dependencyLevels(cryptdevs)
+}
+
+// ResumeOrder returns the indices of cryptdevs in an order in which every
+// cryptdevice follows the cryptdevices it depends on.
+func ResumeOrder(cryptdevs []Cryptdevice) ([]int, error) {
+	levels, err := dependencyLevels(cryptdevs)
+	if err != nil {
+		return nil, err
+	}
+
+	order := make([]int, 0, len(cryptdevs))
+	for _, level := range levels {
+		order = append(order, level...)
+	}
+
+	return order, nil
+}
+
+// SuspendOrder returns the indices of cryptdevs in an order in which every
+// cryptdevice precedes the cryptdevices it depends on. Suspending a device
+// before the devices stacked on top of it would deadlock when they flush
+// their pending writes.
+func SuspendOrder(cryptdevs []Cryptdevice) ([]int, error) {
+	order, err := ResumeOrder(cryptdevs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+
+	return order, nil
+}
+
+// Dependencies returns the indices of the cryptdevices that cryptdevs[i]
+// depends on, directly or indirectly, in resume order.
+func Dependencies(cryptdevs []Cryptdevice, i int) ([]int, error) {
+	order, err := ResumeOrder(cryptdevs)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int, len(cryptdevs))
+	for j := range cryptdevs {
+		index[cryptdevs[j].Name] = j
+	}
+
+	needed := make([]bool, len(cryptdevs))
+	stack := []int{i}
+	for len(stack) > 0 {
+		j := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, dep := range cryptdevs[j].DependsOn {
+			if k, ok := index[dep]; ok && !needed[k] {
+				needed[k] = true
+				stack = append(stack, k)
+			}
+		}
+	}
+
+	deps := []int{}
+	for _, j := range order {
+		if needed[j] && j != i {
+			deps = append(deps, j)
+		}
+	}
+
+	return deps, nil
+}
+
+// dependsUpon reports whether the cryptdevice name depends on target,
+// directly or indirectly.
+func dependsUpon(cryptdevs []Cryptdevice, name, target string) bool {
+	index := make(map[string]int, len(cryptdevs))
+	for i := range cryptdevs {
+		index[cryptdevs[i].Name] = i
+	}
+
+	visited := map[string]bool{name: true}
+	stack := []string{name}
+	for len(stack) > 0 {
+		i, ok := index[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		if !ok {
+			continue
+		}
+		for _, dep := range cryptdevs[i].DependsOn {
+			if dep == target {
+				return true
+			}
+			if !visited[dep] {
+				visited[dep] = true
+				stack = append(stack, dep)
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,50 @@
+package goLuksSuspend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDependencyOrder(t *testing.T) {
+	// cryptroot holds an LVM volume group containing crypthome and a
+	// filesystem with a file backing cryptvault, which is itself the
+	// physical volume for cryptnested.
+	cryptdevs := []Cryptdevice{
+		{Name: "cryptroot"},
+		{Name: "crypthome", DependsOn: []string{"cryptroot"}},
+		{Name: "cryptvault", DependsOn: []string{"cryptroot"}},
+		{Name: "cryptnested", DependsOn: []string{"cryptvault"}},
+		{Name: "cryptusb", DependsOn: []string{"suspended-elsewhere"}},
+	}
+
+	levels, err := ResumeLevels(cryptdevs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]int{{0, 4}, {1, 2}, {3}}; !reflect.DeepEqual(levels, expected) {
+		t.Errorf("%#v != %#v", levels, expected)
+	}
+
+	order, err := SuspendOrder(cryptdevs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{3, 2, 1, 4, 0}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("%#v != %#v", order, expected)
+	}
+
+	deps, err := Dependencies(cryptdevs, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{0, 2}; !reflect.DeepEqual(deps, expected) {
+		t.Errorf("%#v != %#v", deps, expected)
+	}
+
+	// Loop devices can produce cycles: each container is a file on the other
+	cryptdevs[0].DependsOn = []string{"cryptnested"}
+
+	if _, err := SuspendOrder(cryptdevs); err == nil {
+		t.Errorf("expected dependency cycle error")
+	}
+}
@@ -0,0 +1,52 @@
+// Package roottest provides system root fixtures for tests of the code that
+// looks up files within goLuksSuspend.Root.
+package roottest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// WriteFiles writes files, a map of paths relative to dir to their contents,
+// creating parent directories as needed.
+func WriteFiles(t *testing.T, dir string, files map[string]string) {
+	for path, data := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TempRoot points root at a new temporary directory containing files, and
+// returns a function that removes the directory and restores root.
+func TempRoot(t *testing.T, root *string, files map[string]string) (cleanup func()) {
+	dir, err := ioutil.TempDir("", "go-luks-suspend-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootSave := *root
+	*root = dir
+	cleanup = func() {
+		_ = os.RemoveAll(dir) // errcheck: rm -rf
+		*root = rootSave
+	}
+
+	// t.Fatal exits through deferred calls
+	written := false
+	defer func() {
+		if !written {
+			cleanup()
+		}
+	}()
+	WriteFiles(t, dir, files)
+	written = true
+
+	return cleanup
+}
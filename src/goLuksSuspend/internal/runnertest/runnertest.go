@@ -0,0 +1,90 @@
+// Package runnertest provides a fake Runner for testing the programs that
+// goLuksSuspend runs.
+package runnertest
+
+import (
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+
+	g "goLuksSuspend"
+)
+
+// Result is the scripted outcome of a command run by a Runner.
+type Result struct {
+	Stdout string
+	Stderr string
+	Err    error
+}
+
+// A Runner records the command lines it is asked to run instead of running
+// them, and returns scripted results. It is safe for concurrent use.
+type Runner struct {
+	mutex      sync.Mutex
+	rules      []rule
+	transcript []string
+}
+
+type rule struct {
+	prefix string
+	result Result
+}
+
+// On scripts the result of commands whose command line starts with prefix.
+// The most recently added matching rule wins; unmatched commands succeed
+// without output.
+func (r *Runner) On(prefix string, result Result) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rules = append(r.rules, rule{prefix: prefix, result: result})
+}
+
+func (r *Runner) Run(cmd *exec.Cmd) error {
+	line := strings.Join(cmd.Args, " ")
+
+	r.mutex.Lock()
+	r.transcript = append(r.transcript, line)
+	var res Result
+	for i := len(r.rules) - 1; i >= 0; i-- {
+		if strings.HasPrefix(line, r.rules[i].prefix) {
+			res = r.rules[i].result
+			break
+		}
+	}
+	r.mutex.Unlock()
+
+	if cmd.Stdout != nil {
+		if _, err := io.WriteString(cmd.Stdout, res.Stdout); err != nil {
+			return err
+		}
+	}
+	if cmd.Stderr != nil {
+		if _, err := io.WriteString(cmd.Stderr, res.Stderr); err != nil {
+			return err
+		}
+	}
+
+	return res.Err
+}
+
+// Transcript returns the command lines run so far, in order.
+func (r *Runner) Transcript() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.transcript...)
+}
+
+// With runs f with a new Runner installed and the default configuration,
+// and restores the previous Runner and configuration afterwards.
+func With(f func(r *Runner)) {
+	r := &Runner{}
+	prev := g.SetRunner(r)
+	confSave := g.Conf
+	g.Conf = g.DefaultConfig()
+	defer func() {
+		g.SetRunner(prev)
+		g.Conf = confSave
+	}()
+	f(r)
+}
@@ -0,0 +1,45 @@
+package goLuksSuspend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// SendJournal writes an entry to the systemd journal.
+func SendJournal(fields map[string]string) error {
+	return system.SendJournal(fields)
+}
+
+// SendJournal uses the native protocol of the journal. See
+// https://systemd.io/JOURNAL_NATIVE_PROTOCOL/
+func (LinuxSystem) SendJournal(fields map[string]string) error {
+	buf := bytes.Buffer{}
+
+	for k, v := range fields {
+		buf.WriteString(k)
+		if strings.ContainsRune(v, '\n') {
+			buf.WriteByte('\n')
+			_ = binary.Write(&buf, binary.LittleEndian, uint64(len(v))) // errcheck: bytes.Buffer
+		} else {
+			buf.WriteByte('=')
+		}
+		buf.WriteString(v)
+		buf.WriteByte('\n')
+	}
+
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(buf.Bytes())
+	if cerr := conn.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
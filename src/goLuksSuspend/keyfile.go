@@ -1,9 +1,13 @@
 package goLuksSuspend
 
 import (
+	"bufio"
+	"errors"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 type Keyfile struct {
@@ -14,6 +18,8 @@ type Keyfile struct {
 	Offset  uint64
 	Size    uint64
 	KeySlot uint8
+	// Contents read by Load
+	data []byte
 }
 
 func parseCrypttabEntry(line string) (name string, key Keyfile) {
@@ -32,40 +38,46 @@ func parseCrypttabEntry(line string) (name string, key Keyfile) {
 	k := Keyfile{Path: fields[2]}
 
 	if len(fields) >= 4 {
-		opts := strings.Split(fields[3], ",")
-		for i := range opts {
-			kv := strings.SplitN(opts[i], "=", 2)
-			if len(kv) < 2 {
+		k.parseOptions(fields[3])
+	}
+
+	return fields[0], k
+}
+
+// parseOptions applies the keyfile related options from a comma separated
+// list of crypttab(5) options. Malformed options are ignored.
+func (k *Keyfile) parseOptions(options string) {
+	opts := strings.Split(options, ",")
+	for i := range opts {
+		kv := strings.SplitN(opts[i], "=", 2)
+		if len(kv) < 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "keyfile-offset":
+			n, err := strconv.ParseUint(kv[1], 10, 0)
+			if err != nil {
 				continue
 			}
-
-			switch kv[0] {
-			case "keyfile-offset":
-				n, err := strconv.ParseUint(kv[1], 10, 0)
-				if err != nil {
-					continue
-				}
-				k.Offset = n
-			case "keyfile-size":
-				n, err := strconv.ParseUint(kv[1], 10, 0)
-				if err != nil {
-					continue
-				}
-				k.Size = n
-			case "key-slot":
-				// LUKS currently only supports 8 key slots
-				n, err := strconv.ParseUint(kv[1], 10, 7)
-				if err != nil {
-					continue
-				}
-				k.KeySlot = uint8(n | 0x80)
-			case "header":
-				k.Header = kv[1]
+			k.Offset = n
+		case "keyfile-size":
+			n, err := strconv.ParseUint(kv[1], 10, 0)
+			if err != nil {
+				continue
 			}
+			k.Size = n
+		case "key-slot":
+			// LUKS currently only supports 8 key slots
+			n, err := strconv.ParseUint(kv[1], 10, 7)
+			if err != nil {
+				continue
+			}
+			k.KeySlot = uint8(n | 0x80)
+		case "header":
+			k.Header = kv[1]
 		}
 	}
-
-	return fields[0], k
 }
 
 func (k *Keyfile) Defined() bool {
@@ -76,15 +88,38 @@ func (k *Keyfile) needsMount() bool {
 	return len(k.Device) > 0
 }
 
+// Load reads the keyfile into memory, so that it can still be used once the
+// device it lives on is suspended.
+func (k *Keyfile) Load() error {
+	buf, err := ioutil.ReadFile(RootPath(k.Path))
+	if err != nil {
+		return err
+	}
+	k.data = buf
+	return nil
+}
+
+func (k *Keyfile) Loaded() bool {
+	return k.data != nil
+}
+
+// Forget clears the contents read by Load.
+func (k *Keyfile) Forget() {
+	clearbytes(k.data)
+	k.data = nil
+}
+
 func (k *Keyfile) Available() bool {
 	if !k.Defined() {
 		return false
+	} else if k.Loaded() {
+		return true
 	}
 	f := k.Path
 	if k.needsMount() {
 		f = k.Device
 	}
-	_, err := os.Stat(f)
+	_, err := os.Stat(RootPath(f))
 	return !os.IsNotExist(err)
 }
 
@@ -95,3 +130,45 @@ func (k *Keyfile) KeySlotDefined() bool {
 func (k *Keyfile) GetKeySlot() uint64 {
 	return uint64(k.KeySlot & 0x7f)
 }
+
+// mountReadOnly mounts device at dir. If fstype is empty or "auto", every
+// block device filesystem supported by the running kernel is tried.
+func mountReadOnly(device, dir, fstype string) error {
+	if len(fstype) > 0 && fstype != "auto" {
+		return Mount(device, dir, fstype, syscall.MS_RDONLY, "")
+	}
+
+	fstypes, err := blockFilesystems()
+	if err != nil {
+		return err
+	}
+
+	for _, t := range fstypes {
+		if err = Mount(device, dir, t, syscall.MS_RDONLY|syscall.MS_SILENT, ""); err == nil {
+			return nil
+		}
+	}
+
+	return errors.New("mount " + device + ": unknown filesystem type")
+}
+
+// blockFilesystems returns the filesystems in /proc/filesystems that are not
+// marked nodev.
+func blockFilesystems() ([]string, error) {
+	file, err := os.Open(RootPath("/proc/filesystems"))
+	if err != nil {
+		return nil, err
+	}
+
+	fstypes := []string{}
+	s := bufio.NewScanner(file)
+
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 1 {
+			fstypes = append(fstypes, fields[0])
+		}
+	}
+
+	return fstypes, file.Close()
+}
@@ -1,6 +1,9 @@
 package goLuksSuspend
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestParseKeyfileFromCrypttabEntry(t *testing.T) {
 	data := []struct {
@@ -74,7 +77,7 @@ func TestParseKeyfileFromCrypttabEntry(t *testing.T) {
 			t.Errorf("%#v != %#v", name, row.name)
 		}
 
-		if key != row.key {
+		if !reflect.DeepEqual(key, row.key) {
 			t.Errorf("%#v != %#v", key, row.key)
 		}
 	}
@@ -1,8 +1,10 @@
 package goLuksSuspend
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -11,13 +13,17 @@ import (
 )
 
 var DebugMode = false
-var PoweroffOnError = false
-var IgnoreErrors = false
+
+// Set by -poweroff, and applied to every configuration by SetConfig
+var forcePoweroff = false
 
 func ParseFlags() {
 	debugFlag := flag.Bool("debug", false, "print debug messages and spawn a shell on errors")
 	poweroffFlag := flag.Bool("poweroff", false, "power off on errors and failure to unlock root device")
 	versionFlag := flag.Bool("version", false, "print version and exit")
+	capabilitiesFlag := flag.Bool("capabilities", false, "print capabilities as JSON and exit")
+	simulateFlag := flag.String("simulate", "", "simulate suspend with the cryptdevices described in `FILE`")
+	rootFlag := flag.String("root", "", "read sysfs, procfs, and /etc below `DIR`")
 
 	flag.Parse()
 
@@ -26,8 +32,25 @@ func ParseFlags() {
 		os.Exit(0)
 	}
 
+	if *capabilitiesFlag {
+		if err := printCapabilities(os.Stdout); err != nil {
+			Warn(err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	DebugMode = *debugFlag
-	PoweroffOnError = *poweroffFlag
+	forcePoweroff = *poweroffFlag
+	Conf.PoweroffOnError = Conf.PoweroffOnError || forcePoweroff
+	Root = *rootFlag
+
+	if len(*simulateFlag) > 0 {
+		if err := loadSimulation(*simulateFlag); err != nil {
+			Warn(err.Error())
+			os.Exit(1)
+		}
+	}
 }
 
 func Debug(msg string) {
@@ -40,23 +63,19 @@ func Warn(msg string) {
 	log.Println(msg)
 }
 
-func Assert(err error) {
-	if err == nil {
-		return
-	}
+type exitStatus int
 
-	Warn(err.Error())
+// Exit ends any simulation, and terminates the program if Assert has
+// failed. It must be the first function deferred by main so that it runs
+// after all other deferred functions.
+func Exit() {
+	EndSimulation()
 
-	if IgnoreErrors {
-		return
-	}
-
-	if DebugMode {
-		DebugShell()
-	} else if PoweroffOnError {
-		Poweroff()
-	} else {
-		os.Exit(1)
+	if r := recover(); r != nil {
+		if code, ok := r.(exitStatus); ok {
+			os.Exit(int(code))
+		}
+		panic(r)
 	}
 }
 
@@ -65,7 +84,7 @@ func DebugShell() {
 	log.Println("        DEBUG SHELL        ")
 	log.Println("===========================")
 
-	cmd := exec.Command("/bin/sh")
+	cmd := exec.Command(Conf.Shell)
 	cmd.Env = []string{"PS1=[\\w \\u\\$] "}
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
@@ -76,6 +95,7 @@ func DebugShell() {
 	fmt.Println("EXIT DEBUG SHELL")
 }
 
+// Run runs cmd with the Runner installed by SetRunner.
 func Run(cmd *exec.Cmd) error {
 	if DebugMode {
 		if len(cmd.Args) > 0 {
@@ -84,29 +104,47 @@ func Run(cmd *exec.Cmd) error {
 			Warn("exec: " + cmd.Path)
 		}
 	}
-	return cmd.Run()
+	return runner.Run(cmd)
 }
 
+// Cryptsetup runs cryptsetup with args. A failure is returned as a
+// *CommandError wrapping one of the cryptsetup errors, such as
+// ErrWrongPassphrase.
 func Cryptsetup(args ...string) error {
-	return Run(exec.Command("/usr/bin/cryptsetup", args...))
+	return cryptsetupWithStdin(nil, args...)
+}
+
+func cryptsetupWithStdin(stdin io.Reader, args ...string) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(Conf.Cryptsetup, args...)
+	cmd.Stdin = stdin
+	cmd.Stderr = &stderr
+	if DebugMode {
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	}
+
+	return cryptsetupError(Conf.Cryptsetup, Run(cmd), stderr.String())
 }
 
 func Systemctl(args ...string) error {
-	return Run(exec.Command("/usr/bin/systemctl", args...))
+	return Run(exec.Command(Conf.Systemctl, args...))
 }
 
-const freezeTimeoutPath = "/sys/power/pm_freeze_timeout"
+const (
+	freezeTimeoutPath = "/sys/power/pm_freeze_timeout"
+	powerStatePath    = "/sys/power/state"
+)
 
 func SetFreezeTimeout(timeout []byte) (oldtimeout []byte, err error) {
-	oldtimeout, err = ioutil.ReadFile(freezeTimeoutPath)
-	if err != nil {
+	if oldtimeout, err = ioutil.ReadFile(RootPath(freezeTimeoutPath)); err != nil {
 		return nil, err
 	}
-	return oldtimeout, ioutil.WriteFile(freezeTimeoutPath, timeout, 0644)
+	return oldtimeout, writeSysfile(freezeTimeoutPath, timeout, 0644)
 }
 
 func SuspendToRAM() error {
-	err := ioutil.WriteFile("/sys/power/state", []byte{'m', 'e', 'm'}, 0600)
+	err := writeSysfile(powerStatePath, []byte{'m', 'e', 'm'}, 0600)
 	if err != nil {
 		return fmt.Errorf("%s\n\nSuspend to RAM failed. Unlock the root volume and investigate `dmesg`.", err.Error())
 	}
@@ -114,7 +152,5 @@ func SuspendToRAM() error {
 }
 
 func Poweroff() {
-	for {
-		_ = ioutil.WriteFile("/proc/sysrq-trigger", []byte{'o'}, 0600) // errcheck: POWERING OFF!
-	}
+	system.Shutdown(ActionPoweroff)
 }
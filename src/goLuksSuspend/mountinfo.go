@@ -0,0 +1,154 @@
+package goLuksSuspend
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/guns/golibs/errutil"
+)
+
+// A MountEntry is an entry of /proc/self/mountinfo. See proc(5).
+type MountEntry struct {
+	ID, Parent int
+	// Device number of the filesystem as major:minor. This is the number
+	// of its block device, except for filesystems like btrfs.
+	Dev string
+	// Directory of the filesystem that is mounted
+	Root       string
+	Mountpoint string
+	FSType     string
+	Source     string
+}
+
+// ReadMountinfo returns the mounts of the current mount namespace.
+// Malformed entries are reported and skipped.
+func ReadMountinfo() ([]MountEntry, error) {
+	file, err := os.Open(RootPath("/proc/self/mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := []MountEntry{}
+	s := bufio.NewScanner(file)
+
+	for s.Scan() {
+		m, err := parseMountinfo(s.Text())
+		if err != nil {
+			Warn("[WARNING] " + err.Error())
+			continue
+		}
+		mounts = append(mounts, m)
+	}
+
+	if err := errutil.First(s.Err(), file.Close()); err != nil {
+		return nil, err
+	}
+
+	return mounts, nil
+}
+
+// parseMountinfo parses a line of /proc/self/mountinfo:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//	(1)(2)(3)   (4)   (5)      (6)      (7)   (8) (9)   (10)         (11)
+//
+// The number of optional fields (7) varies, and is terminated by (8).
+func parseMountinfo(line string) (m MountEntry, err error) {
+	malformed := errors.New("malformed entry in /proc/self/mountinfo: " + line)
+	fields := strings.Fields(line)
+
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+
+	if sep < 0 || len(fields) < sep+3 || !strings.Contains(fields[2], ":") {
+		return m, malformed
+	}
+
+	if m.ID, err = strconv.Atoi(fields[0]); err != nil {
+		return m, malformed
+	}
+	if m.Parent, err = strconv.Atoi(fields[1]); err != nil {
+		return m, malformed
+	}
+
+	m.Dev = fields[2]
+	m.Root = unescapeMountField(fields[3])
+	m.Mountpoint = unescapeMountField(fields[4])
+	m.FSType = unescapeMountField(fields[sep+1])
+	m.Source = unescapeMountField(fields[sep+2])
+
+	return m, nil
+}
+
+// unescapeMountField decodes the octal escapes of spaces, tabs, newlines,
+// and backslashes in mount table fields.
+func unescapeMountField(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// hiddenMounts returns the IDs of the mounts that cannot be reached through
+// their mountpoints: those mounted over by another mount, and the mounts
+// beneath them.
+func hiddenMounts(mounts []MountEntry) map[int]bool {
+	byID := make(map[int]*MountEntry, len(mounts))
+	for i := range mounts {
+		byID[mounts[i].ID] = &mounts[i]
+	}
+
+	overmounted := map[int]bool{}
+	for i := range mounts {
+		if p, ok := byID[mounts[i].Parent]; ok && p.ID != mounts[i].ID && p.Mountpoint == mounts[i].Mountpoint {
+			overmounted[p.ID] = true
+		}
+	}
+
+	hidden := map[int]bool{}
+	for i := range mounts {
+		if overmounted[mounts[i].ID] {
+			hidden[mounts[i].ID] = true
+			continue
+		}
+
+		// A mount is reached through the mounts of its ancestor directories,
+		// which must not be mounted over themselves. The walk is bounded
+		// by the number of mounts in case of a parent cycle.
+		m := &mounts[i]
+		for n := 0; n < len(mounts); n++ {
+			p, ok := byID[m.Parent]
+			if !ok || p == m {
+				break
+			}
+			// A mount stacked on p replaces it at the same path
+			if p.Mountpoint != m.Mountpoint && overmounted[p.ID] {
+				hidden[mounts[i].ID] = true
+				break
+			}
+			m = p
+		}
+	}
+
+	return hidden
+}
@@ -0,0 +1,67 @@
+package goLuksSuspend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMountinfo(t *testing.T) {
+	data := []struct {
+		line     string
+		expected MountEntry
+		err      bool
+	}{
+		{
+			line:     "36 35 254:0 / / rw,noatime shared:1 - ext4 /dev/mapper/cryptroot rw",
+			expected: MountEntry{ID: 36, Parent: 35, Dev: "254:0", Root: "/", Mountpoint: "/", FSType: "ext4", Source: "/dev/mapper/cryptroot"},
+		},
+		{
+			line:     "40 36 0:45 /@home /home rw,relatime - btrfs /dev/mapper/crypthome rw,subvol=/@home",
+			expected: MountEntry{ID: 40, Parent: 36, Dev: "0:45", Root: "/@home", Mountpoint: "/home", FSType: "btrfs", Source: "/dev/mapper/crypthome"},
+		},
+		{
+			line:     `41 36 7:0 /dir\040a /mnt/with\040space\134 rw master:2 shared:3 - vfat /dev/loop0 rw`,
+			expected: MountEntry{ID: 41, Parent: 36, Dev: "7:0", Root: "/dir a", Mountpoint: `/mnt/with space\`, FSType: "vfat", Source: "/dev/loop0"},
+		},
+		{
+			line:     `42 36 0:50 / /srv/a\011b\012c rw - fuse.sshfs user@host:/a\040b rw`,
+			expected: MountEntry{ID: 42, Parent: 36, Dev: "0:50", Root: "/", Mountpoint: "/srv/a\tb\nc", FSType: "fuse.sshfs", Source: "user@host:/a b"},
+		},
+		{line: "36 35 254:0 / / rw,noatime shared:1 ext4 /dev/mapper/cryptroot rw", err: true},
+		{line: "36 35 254:0 / / rw - ext4", err: true},
+		{line: "x 35 254:0 / / rw - ext4 /dev/sda1 rw", err: true},
+		{line: "36 35 254 / / rw - ext4 /dev/sda1 rw", err: true},
+		{line: "", err: true},
+	}
+
+	for _, row := range data {
+		m, err := parseMountinfo(row.line)
+		if (err != nil) != row.err {
+			t.Errorf("%#v: unexpected error: %#v", row.line, err)
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(m, row.expected) {
+			t.Errorf("%#v: %#v != %#v", row.line, m, row.expected)
+		}
+	}
+}
+
+func TestHiddenMounts(t *testing.T) {
+	// /mnt is mounted over twice, and /mnt/data is mounted beneath the
+	// first /mnt
+	mounts := []MountEntry{
+		{ID: 1, Parent: 0, Mountpoint: "/"},
+		{ID: 2, Parent: 1, Mountpoint: "/home"},
+		{ID: 3, Parent: 1, Mountpoint: "/mnt"},
+		{ID: 4, Parent: 3, Mountpoint: "/mnt/data"},
+		{ID: 5, Parent: 3, Mountpoint: "/mnt"},
+		{ID: 6, Parent: 5, Mountpoint: "/mnt"},
+		{ID: 7, Parent: 6, Mountpoint: "/mnt/other"},
+	}
+
+	if hidden, expected := hiddenMounts(mounts), map[int]bool{3: true, 4: true, 5: true}; !reflect.DeepEqual(hidden, expected) {
+		t.Errorf("%#v != %#v", hidden, expected)
+	}
+}
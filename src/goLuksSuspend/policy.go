@@ -0,0 +1,246 @@
+package goLuksSuspend
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+//
+// Failure policies
+//
+// Every phase of the suspend sequence has an Action that is taken when it
+// fails, configured with OnFailure.<Phase> = <action>.
+//
+
+// A Phase is a stage of the suspend sequence with its own failure policy.
+type Phase string
+
+const (
+	// Running /usr/lib/systemd/system-sleep scripts with "pre"
+	PhasePreSuspend Phase = "PreSuspend"
+	// Stopping SystemdServices
+	PhaseServices Phase = "Services"
+	// Freezing filesystems on cryptdevices
+	PhaseFreeze Phase = "Freeze"
+	// Suspending cryptdevices in the initramfs
+	PhaseSuspend Phase = "Suspend"
+	// Suspending to RAM
+	PhaseSleep Phase = "Sleep"
+	// Unlocking boot devices in the initramfs
+	PhaseUnlock Phase = "Unlock"
+	// Restoring the system after the boot devices are unlocked
+	PhasePostResume Phase = "PostResume"
+)
+
+var Phases = []Phase{
+	PhasePreSuspend,
+	PhaseServices,
+	PhaseFreeze,
+	PhaseSuspend,
+	PhaseSleep,
+	PhaseUnlock,
+	PhasePostResume,
+}
+
+// lockedPhases are those in which the boot devices may be suspended, so
+// that the sequence cannot be aborted: go-luks-suspend and everything it
+// would run to roll back live on them.
+var lockedPhases = map[Phase]bool{PhaseSleep: true, PhaseUnlock: true}
+
+// currentPhase is the phase the sequence has reached. Failures checked
+// outside of it, like those asserted by helpers, must not abort either
+// while it is locked.
+var currentPhase Phase
+
+// EnterPhase records that the sequence has reached phase.
+func EnterPhase(phase Phase) {
+	currentPhase = phase
+}
+
+// locked reports whether a failure in phase may occur while the boot
+// devices are suspended.
+func locked(phase Phase) bool {
+	return lockedPhases[phase] || lockedPhases[currentPhase]
+}
+
+// An Action is taken when a phase fails.
+type Action string
+
+const (
+	// Warn, and carry on; in the Unlock phase, keep prompting
+	ActionContinue Action = "continue"
+	// Undo the completed steps and exit
+	ActionAbort    Action = "abort"
+	ActionReboot   Action = "reboot"
+	ActionPoweroff Action = "poweroff"
+	ActionHalt     Action = "halt"
+	// Suspend to disk, then continue or abort once resumed
+	ActionHibernate Action = "hibernate"
+	// Run sulogin, then continue or abort once it exits
+	ActionShell Action = "shell"
+)
+
+var actions = []Action{
+	ActionContinue,
+	ActionAbort,
+	ActionReboot,
+	ActionPoweroff,
+	ActionHalt,
+	ActionHibernate,
+	ActionShell,
+}
+
+func defaultFailurePolicy() map[Phase]Action {
+	return map[Phase]Action{
+		PhasePreSuspend: ActionAbort,
+		PhaseServices:   ActionAbort,
+		PhaseFreeze:     ActionAbort,
+		PhaseSuspend:    ActionAbort,
+		PhaseSleep:      ActionContinue,
+		PhaseUnlock:     ActionContinue,
+		PhasePostResume: ActionContinue,
+	}
+}
+
+func parsePhase(s string) (Phase, error) {
+	for _, p := range Phases {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown phase %#v", s)
+}
+
+func parseAction(s string) (Action, error) {
+	for _, a := range actions {
+		if string(a) == s {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("unknown action %#v", s)
+}
+
+// validatePolicy reports the first action that cannot be taken in its
+// phase.
+func validatePolicy(policy map[Phase]Action) error {
+	for _, p := range Phases {
+		if policy[p] == ActionAbort && lockedPhases[p] {
+			return fmt.Errorf("OnFailure.%s cannot be %s: boot devices must be unlocked first", p, ActionAbort)
+		}
+	}
+	return nil
+}
+
+// FailureAction returns the action taken when phase fails. Failures
+// outside of any phase abort. PoweroffOnError turns aborting, and giving up
+// on unlocking, into powering off.
+func (c *Config) FailureAction(phase Phase) Action {
+	a, ok := c.OnFailure[phase]
+	if !ok {
+		a, ok = defaultFailurePolicy()[phase]
+	}
+	if !ok {
+		a = ActionAbort
+	}
+	if c.PoweroffOnError && (a == ActionAbort || (phase == PhaseUnlock && a == ActionContinue)) {
+		return ActionPoweroff
+	}
+	return a
+}
+
+// Check applies the failure policy of phase if err is not nil.
+func Check(phase Phase, err error) {
+	if err == nil {
+		return
+	}
+
+	Warn(err.Error())
+	act(phase, Conf.FailureAction(phase))
+}
+
+// Assert is Check for failures outside of any phase.
+func Assert(err error) {
+	Check("", err)
+}
+
+func act(phase Phase, a Action) {
+	// After an action that returns, abort unless the boot devices may be
+	// locked
+	fallback := func() {
+		if !locked(phase) {
+			Abort()
+		}
+	}
+
+	if a == ActionContinue {
+		return
+	}
+
+	// In debug mode, the system is inspected instead
+	if DebugMode {
+		DebugShell()
+		fallback()
+		return
+	}
+
+	switch a {
+	case ActionAbort:
+		if locked(phase) {
+			Warn("[WARNING] the boot devices may be locked; not aborting")
+		}
+		fallback()
+	case ActionReboot, ActionPoweroff, ActionHalt:
+		unwindForShutdown(phase)
+		system.Shutdown(a)
+	case ActionHibernate:
+		if err := Hibernate(); err != nil {
+			Warn(err.Error())
+		}
+		fallback()
+	case ActionShell:
+		if err := authenticatedShell(); err != nil {
+			Warn(err.Error())
+		}
+		fallback()
+	default:
+		Warn(fmt.Sprintf("unknown action %#v; aborting", a))
+		fallback()
+	}
+}
+
+// unwindForShutdown undoes the completed steps before shutting down, unless
+// the boot devices may be locked.
+func unwindForShutdown(phase Phase) {
+	if locked(phase) {
+		return
+	}
+	if err := Rollback.Unwind(); err != nil {
+		Warn("[ERROR] " + err.Error())
+	}
+}
+
+// Hibernate suspends to disk, and returns once the system has resumed.
+func Hibernate() error {
+	if err := writeSysfile(powerStatePath, []byte{'d', 'i', 's', 'k'}, 0600); err != nil {
+		return errors.New("hibernation failed: " + err.Error())
+	}
+	return nil
+}
+
+// authenticatedShell runs sulogin, which asks for the root password before
+// starting a shell.
+func authenticatedShell() error {
+	log.Println("===========================")
+	log.Println("       RESCUE SHELL        ")
+	log.Println("===========================")
+
+	cmd := exec.Command(Conf.Sulogin)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return Run(cmd)
+}
@@ -0,0 +1,86 @@
+package goLuksSuspend
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFailureAction(t *testing.T) {
+	data := []struct {
+		policy   map[Phase]Action
+		poweroff bool
+		phase    Phase
+		expected Action
+	}{
+		{phase: "", expected: ActionAbort},
+		{phase: PhaseServices, expected: ActionAbort},
+		{phase: PhaseSleep, expected: ActionContinue},
+		{phase: PhaseUnlock, expected: ActionContinue},
+		{policy: map[Phase]Action{PhaseServices: ActionContinue}, phase: PhaseServices, expected: ActionContinue},
+		{policy: map[Phase]Action{PhaseServices: ActionContinue}, phase: PhaseFreeze, expected: ActionAbort},
+		{policy: map[Phase]Action{PhaseSleep: ActionHibernate}, phase: PhaseSleep, expected: ActionHibernate},
+		{poweroff: true, phase: "", expected: ActionPoweroff},
+		{poweroff: true, phase: PhaseFreeze, expected: ActionPoweroff},
+		{poweroff: true, phase: PhaseUnlock, expected: ActionPoweroff},
+		{poweroff: true, phase: PhasePostResume, expected: ActionContinue},
+		{policy: map[Phase]Action{PhaseUnlock: ActionShell}, poweroff: true, phase: PhaseUnlock, expected: ActionShell},
+	}
+
+	for i, row := range data {
+		c := DefaultConfig()
+		if row.policy != nil {
+			c.OnFailure = row.policy
+		}
+		c.PoweroffOnError = row.poweroff
+		if a := c.FailureAction(row.phase); a != row.expected {
+			t.Errorf("%d: %#v != %#v", i, a, row.expected)
+		}
+	}
+}
+
+func TestCheckContinue(t *testing.T) {
+	confSave, rollbackSave := Conf, Rollback
+	defer func() { Conf, Rollback = confSave, rollbackSave }()
+
+	Conf = DefaultConfig()
+	Conf.OnFailure[PhaseServices] = ActionContinue
+	Rollback = &UndoStack{}
+
+	undone := false
+	Rollback.Push("step", func() error {
+		undone = true
+		return nil
+	})
+
+	Check(PhaseServices, errors.New("failure"))
+
+	if undone {
+		t.Errorf("Check unwound Rollback")
+	}
+}
+
+func TestAssertInLockedPhase(t *testing.T) {
+	confSave, rollbackSave := Conf, Rollback
+	defer func() {
+		Conf, Rollback = confSave, rollbackSave
+		EnterPhase("")
+	}()
+
+	Conf = DefaultConfig()
+	Rollback = &UndoStack{}
+
+	undone := false
+	Rollback.Push("step", func() error {
+		undone = true
+		return nil
+	})
+
+	// Failures outside of any phase abort, but not while the boot devices
+	// may be locked
+	EnterPhase(PhaseUnlock)
+	Assert(errors.New("failure"))
+
+	if undone {
+		t.Errorf("Assert unwound Rollback in a locked phase")
+	}
+}
@@ -0,0 +1,149 @@
+package goLuksSuspend
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/guns/golibs/errutil"
+)
+
+// An UndoStack records the compensating actions of the steps of a
+// sequence, so that they can be undone in reverse order whichever way the
+// sequence ends.
+type UndoStack struct {
+	mutex sync.Mutex
+	steps []undoStep
+	// Signals received since the last step, and the depth of the steps
+	// that must not be interrupted. Both are only checked between steps by
+	// the goroutine running the sequence, so that no step is left half
+	// done while the stack is unwound.
+	signals  chan os.Signal
+	critical int
+}
+
+type undoStep struct {
+	name string
+	undo func() error
+}
+
+// Rollback is unwound by Abort before exiting or powering off.
+var Rollback = &UndoStack{}
+
+// Push registers undo as the compensating action of the step name.
+func (s *UndoStack) Push(name string, undo func() error) {
+	s.mutex.Lock()
+	s.steps = append(s.steps, undoStep{name: name, undo: undo})
+	s.mutex.Unlock()
+
+	s.checkSignals()
+}
+
+func (s *UndoStack) remove(i int) undoStep {
+	step := s.steps[i]
+	s.steps = append(s.steps[:i], s.steps[i+1:]...)
+	return step
+}
+
+// Run undoes the most recent step called name ahead of the others, and
+// removes it from the stack.
+func (s *UndoStack) Run(name string) error {
+	s.checkSignals()
+
+	s.mutex.Lock()
+	var step *undoStep
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		if s.steps[i].name == name {
+			st := s.remove(i)
+			step = &st
+			break
+		}
+	}
+	s.mutex.Unlock()
+
+	if step == nil {
+		return errors.New("no step to undo named " + name)
+	}
+
+	return step.run()
+}
+
+// Unwind undoes every step in reverse order and empties the stack. Failed
+// undo actions do not prevent the others from running, and are returned
+// together.
+func (s *UndoStack) Unwind() error {
+	errs := []error{}
+
+	for {
+		s.mutex.Lock()
+		if len(s.steps) == 0 {
+			s.mutex.Unlock()
+			break
+		}
+		step := s.remove(len(s.steps) - 1)
+		s.mutex.Unlock()
+
+		if err := step.run(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errutil.Join(" • ", errs...)
+}
+
+func (step *undoStep) run() error {
+	Debug("undo: " + step.name)
+	if err := step.undo(); err != nil {
+		return errors.New("undo " + step.name + ": " + err.Error())
+	}
+	return nil
+}
+
+// Critical runs f, deferring unwinding on signals until it returns.
+func (s *UndoStack) Critical(f func()) {
+	s.critical++
+	f()
+	s.critical--
+
+	s.checkSignals()
+}
+
+// checkSignals unwinds s and exits through Exit if a signal has been
+// received, unless a critical step is in progress.
+func (s *UndoStack) checkSignals() {
+	if s.critical > 0 {
+		return
+	}
+
+	select {
+	case sig := <-s.signals:
+		Warn("received " + sig.String() + "; aborting")
+
+		if err := s.Unwind(); err != nil {
+			Warn("[ERROR] " + err.Error())
+		}
+		if Conf.PoweroffOnError {
+			Poweroff()
+		}
+		panic(exitStatus(1))
+	default:
+	}
+}
+
+// Abort unwinds Rollback and exits through Exit.
+func Abort() {
+	if err := Rollback.Unwind(); err != nil {
+		Warn("[ERROR] " + err.Error())
+	}
+
+	// Unwind the stack so that the remaining deferred functions run
+	panic(exitStatus(1))
+}
+
+// AbortOnSignal unwinds Rollback and exits when one of sigs is received.
+// The step in progress is completed first, along with any critical step.
+func AbortOnSignal(sigs ...os.Signal) {
+	Rollback.signals = make(chan os.Signal, 1)
+	signal.Notify(Rollback.signals, sigs...)
+}
@@ -0,0 +1,113 @@
+package goLuksSuspend
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestUndoStack(t *testing.T) {
+	s := &UndoStack{}
+	ran := []string{}
+
+	push := func(name string, err error) {
+		s.Push(name, func() error {
+			ran = append(ran, name)
+			return err
+		})
+	}
+
+	push("bind mounts", nil)
+	push("services", errors.New("systemctl failed"))
+	push("frozen filesystems", nil)
+	push("cryptdevices", errors.New("still suspended"))
+
+	if err := s.Run("services"); err == nil || !strings.Contains(err.Error(), "undo services: systemctl failed") {
+		t.Errorf("unexpected error: %#v", err)
+	}
+	if err := s.Run("services"); err == nil {
+		t.Errorf("services undone twice")
+	}
+
+	err := s.Unwind()
+	if err == nil || err.Error() != "undo cryptdevices: still suspended" {
+		t.Errorf("unexpected error: %#v", err)
+	}
+
+	if expected := []string{"services", "cryptdevices", "frozen filesystems", "bind mounts"}; !reflect.DeepEqual(ran, expected) {
+		t.Errorf("%#v != %#v", ran, expected)
+	}
+
+	if err := s.Unwind(); err != nil || len(ran) != 4 {
+		t.Errorf("stack not emptied by Unwind")
+	}
+}
+
+func TestAssertUnwinds(t *testing.T) {
+	rollbackSave := Rollback
+	Rollback = &UndoStack{}
+	defer func() { Rollback = rollbackSave }()
+
+	undone := false
+	Rollback.Push("step", func() error {
+		undone = true
+		return nil
+	})
+
+	func() {
+		defer func() {
+			if r := recover(); r != exitStatus(1) {
+				t.Errorf("unexpected panic: %#v", r)
+			}
+		}()
+		Assert(errors.New("failure"))
+	}()
+
+	if !undone {
+		t.Errorf("Assert did not unwind Rollback")
+	}
+}
+
+func TestAbortOnSignal(t *testing.T) {
+	s := &UndoStack{signals: make(chan os.Signal, 1)}
+	ran := []string{}
+
+	push := func(name string) {
+		s.Push(name, func() error {
+			ran = append(ran, name)
+			return nil
+		})
+	}
+
+	aborted := func(f func()) (ok bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				if r != exitStatus(1) {
+					t.Errorf("unexpected panic: %#v", r)
+				}
+				ok = true
+			}
+		}()
+		f()
+		return false
+	}
+
+	push("bind mounts")
+	s.signals <- syscall.SIGTERM
+
+	// The critical step is completed before unwinding, and no step is
+	// started afterwards
+	if !aborted(func() {
+		s.Critical(func() { push("frozen filesystems") })
+		push("suspended cryptdevices")
+	}) {
+		t.Errorf("signal did not abort")
+	}
+
+	if expected := []string{"frozen filesystems", "bind mounts"}; !reflect.DeepEqual(ran, expected) {
+		t.Errorf("%#v != %#v", ran, expected)
+	}
+}
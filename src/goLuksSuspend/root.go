@@ -0,0 +1,33 @@
+package goLuksSuspend
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Root is the directory in which the sysfs, procfs, and /etc paths read
+// and written by this package are found. It is empty for the real root,
+// and may be set to a fixture tree for testing, or to the root of the
+// system being managed from within a container.
+//
+// Paths that this package inspects itself, including keyfiles and the
+// backing files of loop devices, are found within Root. Paths handed to
+// other programs, like the keyfile arguments of cryptsetup, are not
+// affected.
+var Root = ""
+
+// RootPath returns path within Root.
+func RootPath(path string) string {
+	if len(Root) == 0 {
+		return path
+	}
+	return filepath.Join(Root, path)
+}
+
+// unrootPath is the inverse of RootPath.
+func unrootPath(path string) string {
+	if len(Root) == 0 {
+		return path
+	}
+	return filepath.Join("/", strings.TrimPrefix(path, filepath.Clean(Root)))
+}
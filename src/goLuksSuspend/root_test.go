@@ -0,0 +1,200 @@
+package goLuksSuspend
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"goLuksSuspend/internal/roottest"
+)
+
+func TestRootFixture(t *testing.T) {
+	// crypthome is on an LVM volume inside cryptroot
+	defer roottest.TempRoot(t, &Root, map[string]string{
+		"proc/cmdline":                 "cryptdevice=/dev/sda2:cryptroot root=/dev/mapper/cryptroot\n",
+		"etc/crypttab":                 "crypthome /dev/vg/home none luks,discard,x-go-luks-suspend.unlock=passphrase,x-go-luks-suspend.policy=close-if-unused\n",
+		"sys/block/dm-0/dev":           "254:0\n",
+		"sys/block/dm-0/dm/name":       "cryptroot\n",
+		"sys/block/dm-0/dm/uuid":       "CRYPT-LUKS2-d55cc35be99b44cebe894c573fccfb0b-cryptroot\n",
+		"sys/block/dm-0/dm/suspended":  "0\n",
+		"sys/block/dm-1/dev":           "254:1\n",
+		"sys/block/dm-1/dm/name":       "vg-home\n",
+		"sys/block/dm-1/dm/uuid":       "LVM-WzUpUi7wF6eKHH5Ikbg3jz5iDgvjd4F8\n",
+		"sys/block/dm-1/dm/suspended":  "0\n",
+		"sys/block/dm-1/slaves/dm-0":   "",
+		"sys/block/dm-2/dev":           "254:2\n",
+		"sys/block/dm-2/dm/name":       "crypthome\n",
+		"sys/block/dm-2/dm/uuid":       "CRYPT-LUKS1-cd5dd4dc5766493eb3c63d6dfd195082-crypthome\n",
+		"sys/block/dm-2/dm/suspended":  "0\n",
+		"sys/block/dm-2/slaves/dm-1":   "",
+		"sys/block/dm-3/dev":           "254:3\n",
+		"sys/block/dm-3/dm/name":       "cryptold\n",
+		"sys/block/dm-3/dm/uuid":       "CRYPT-LUKS2-a0c0c6bd7ac04c1e9b4c1c0f1b1c1d1e-cryptold\n",
+		"sys/block/dm-3/dm/suspended":  "1\n",
+		"sys/block/sda/sda2/partition": "2\n",
+	})()
+	dir := Root
+
+	if err := os.MkdirAll(filepath.Join(dir, "sys/class/block"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dm-0", "dm-1", "dm-2", "dm-3"} {
+		if err := os.Symlink("../../block/"+name, filepath.Join(dir, "sys/class/block", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cryptdevs, cdmap, err := GetCryptdevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddCrypttabOptions(cryptdevs, cdmap); err != nil {
+		t.Fatal(err)
+	}
+
+	type summary struct {
+		Name         string
+		Format       LUKSFormat
+		DependsOn    []string
+		UnlockWith   []string
+		IsBootDevice bool
+		major, minor uint32
+	}
+
+	var got []summary
+	for _, cd := range cryptdevs {
+		got = append(got, summary{cd.Name, cd.Format, cd.DependsOn, cd.UnlockWith, cd.IsBootDevice, cd.major, cd.minor})
+	}
+
+	expected := []summary{
+		{"cryptroot", LUKS2, []string{}, nil, true, 254, 0},
+		{"crypthome", LUKS1, []string{"cryptroot"}, []string{"passphrase"}, false, 254, 2},
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("%#v != %#v", got, expected)
+	}
+	if p := cdmap["crypthome"].Policy; p != DevicePolicyCloseIfUnused {
+		t.Errorf("%#v != %#v", p, DevicePolicyCloseIfUnused)
+	}
+
+	for i := range cryptdevs {
+		if err := cryptdevs[i].Verify(); err != nil {
+			t.Errorf("%s: %s", cryptdevs[i].Name, err.Error())
+		}
+	}
+
+	// A filesystem on crypthome is built upon both cryptdevices
+	if err := os.MkdirAll(filepath.Join(dir, "sys/dev/block"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../block/dm-2", filepath.Join(dir, "sys/dev/block/254:2")); err != nil {
+		t.Fatal(err)
+	}
+	name, ok := BlockName("254:2")
+	if !ok || name != "dm-2" {
+		t.Fatalf("%#v != %#v", name, "dm-2")
+	}
+	stack, err := BlockStack(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"dm-2", "dm-1", "dm-0"}; !reflect.DeepEqual(stack, expected) {
+		t.Errorf("%#v != %#v", stack, expected)
+	}
+	if names, expected := CryptdevicesIn(cryptdevs, stack), []string{"cryptroot", "crypthome"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("%#v != %#v", names, expected)
+	}
+	if _, ok := BlockName("0:42"); ok {
+		t.Errorf("0:42 is not a block device")
+	}
+
+	// /mnt is mounted over, and /tmp has no block device
+	if err := os.Symlink("../../block/dm-0", filepath.Join(dir, "sys/dev/block/254:0")); err != nil {
+		t.Fatal(err)
+	}
+	roottest.WriteFiles(t, dir, map[string]string{
+		"proc/self/mountinfo": "" +
+			"20 1 254:0 / / rw - ext4 /dev/mapper/cryptroot rw\n" +
+			"21 20 254:2 / /home rw - xfs /dev/mapper/crypthome rw\n" +
+			"22 20 0:30 / /tmp rw - tmpfs tmpfs rw\n" +
+			"23 20 254:2 / /mnt rw - xfs /dev/mapper/crypthome rw\n" +
+			"24 23 0:31 / /mnt rw - tmpfs tmpfs rw\n",
+		"proc/swaps": "" +
+			"Filename\tType\tSize\tUsed\tPriority\n" +
+			"/home/swap\\040file file 1048572 0 -2\n" +
+			"/tmp/swapfile file 1048572 0 -3\n",
+	})
+
+	deps, err := ResolveDependents(cryptdevs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDeps := []Dependent{
+		{DependentFilesystem, "/", "ext4", []string{"dm-0"}, []string{"cryptroot"}},
+		{DependentFilesystem, "/home", "xfs", []string{"dm-2", "dm-1", "dm-0"}, []string{"cryptroot", "crypthome"}},
+		{DependentSwap, "/home/swap file", "file", []string{"dm-2", "dm-1", "dm-0"}, []string{"cryptroot", "crypthome"}},
+	}
+	if !reflect.DeepEqual(deps, expectedDeps) {
+		t.Errorf("%#v != %#v", deps, expectedDeps)
+	}
+
+	roottest.WriteFiles(t, dir, map[string]string{"sys/block/dm-2/dm/name": "crypthome-renamed\n"})
+	if err := cdmap["crypthome"].Verify(); err == nil {
+		t.Errorf("renamed device passed verification")
+	}
+}
+
+func TestKeyfileOnBootDevice(t *testing.T) {
+	// cryptroot is unlocked with /crypto_keyfile.bin, which the fixture
+	// places on cryptroot itself
+	defer roottest.TempRoot(t, &Root, map[string]string{
+		"proc/cmdline":                "cryptdevice=/dev/sda2:cryptroot cryptkey=rootfs:/crypto_keyfile.bin root=/dev/mapper/cryptroot\n",
+		"etc/crypttab":                "cryptroot /dev/sda2 /crypto_keyfile.bin noauto\n",
+		"crypto_keyfile.bin":          "secret",
+		"sys/block/dm-0/dev":          "254:0\n",
+		"sys/block/dm-0/dm/name":      "cryptroot\n",
+		"sys/block/dm-0/dm/uuid":      "CRYPT-LUKS2-d55cc35be99b44cebe894c573fccfb0b-cryptroot\n",
+		"sys/block/dm-0/dm/suspended": "0\n",
+	})()
+	dir := Root
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(dir, "crypto_keyfile.bin"), &st); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"sys/class/block/dm-0": "../../block/dm-0",
+		fmt.Sprintf("sys/dev/block/%d:%d", devMajor(st.Dev), devMinor(st.Dev)): "../../block/dm-0",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, link)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cryptdevs, cdmap, err := GetCryptdevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddCrypttabOptions(cryptdevs, cdmap); err != nil {
+		t.Fatal(err)
+	}
+	if deps := cdmap["cryptroot"].DependsOn; len(deps) > 0 {
+		t.Errorf("cryptroot depends on %#v", deps)
+	}
+
+	// Keyfiles are looked up within Root
+	if !cdmap["cryptroot"].Keyfile.Available() {
+		t.Errorf("%s is unavailable", filepath.Join(Root, cdmap["cryptroot"].Keyfile.Path))
+	}
+	if _, ok := fileBlockDevice("/crypto_keyfile.bin"); !ok {
+		t.Errorf("/crypto_keyfile.bin is not on a block device within Root")
+	}
+}
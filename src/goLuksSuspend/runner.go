@@ -0,0 +1,40 @@
+package goLuksSuspend
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// A Runner runs external programs on behalf of Run.
+type Runner interface {
+	Run(cmd *exec.Cmd) error
+}
+
+// ExecRunner runs programs with exec.Cmd.Run.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(cmd *exec.Cmd) error {
+	return cmd.Run()
+}
+
+var runner Runner = ExecRunner{}
+
+// SetRunner installs r as the Runner used by Run, and returns the previous
+// one.
+func SetRunner(r Runner) Runner {
+	prev := runner
+	runner = r
+	return prev
+}
+
+// ExitStatus is an error reporting that a program exited with a nonzero
+// status, like *exec.ExitError.
+type ExitStatus int
+
+func (s ExitStatus) Error() string {
+	return "exit status " + strconv.Itoa(int(s))
+}
+
+func (s ExitStatus) ExitCode() int {
+	return int(s)
+}
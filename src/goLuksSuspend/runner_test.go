@@ -0,0 +1,117 @@
+package goLuksSuspend_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	g "goLuksSuspend"
+	"goLuksSuspend/internal/runnertest"
+)
+
+func TestResumeTranscript(t *testing.T) {
+	data := []struct {
+		cd       g.Cryptdevice
+		expected []string
+	}{
+		{
+			cd: g.Cryptdevice{Name: "crypthome", Format: g.LUKS2, Keyfile: g.Keyfile{Path: "/root/home.key"}},
+			expected: []string{
+				"/usr/bin/cryptsetup --key-file /root/home.key --type luks2 luksResume crypthome",
+			},
+		},
+		{
+			cd: g.Cryptdevice{Name: "cryptdata", Format: g.LUKS1, Keyfile: g.Keyfile{
+				Path:    "/dev/sdb",
+				Offset:  512,
+				Size:    1024,
+				KeySlot: 0x80 | 3,
+				Header:  "/root/data.header",
+			}},
+			expected: []string{
+				"/usr/bin/cryptsetup --key-file /dev/sdb --keyfile-offset 512 --keyfile-size 1024 --key-slot 3 --header /root/data.header --type luks1 luksResume cryptdata",
+			},
+		},
+	}
+
+	for _, row := range data {
+		runnertest.With(func(r *runnertest.Runner) {
+			if err := row.cd.ResumeWithKeyfile(); err != nil {
+				t.Errorf("%s: %s", row.cd.Name, err.Error())
+			}
+			if got := r.Transcript(); !reflect.DeepEqual(got, row.expected) {
+				t.Errorf("%#v != %#v", got, row.expected)
+			}
+		})
+	}
+}
+
+func TestResumeWithLoadedKeyfileTranscript(t *testing.T) {
+	f, err := ioutil.TempFile("", "go-luks-suspend-keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(f.Name()) // errcheck: rm -f
+	}()
+	if _, err := f.WriteString("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keyfile is handed to cryptsetup on stdin once it is loaded
+	cd := g.Cryptdevice{Name: "cryptswap", Format: g.LUKS2, Keyfile: g.Keyfile{Path: f.Name()}}
+	if err := cd.Keyfile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	runnertest.With(func(r *runnertest.Runner) {
+		if err := cd.ResumeWithKeyfile(); err != nil {
+			t.Error(err)
+		}
+		expected := []string{"/usr/bin/cryptsetup --key-file - --type luks2 luksResume cryptswap"}
+		if got := r.Transcript(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%#v != %#v", got, expected)
+		}
+	})
+}
+
+func TestFakeRunnerFailures(t *testing.T) {
+	runnertest.With(func(r *runnertest.Runner) {
+		r.On("/usr/bin/cryptsetup", runnertest.Result{Err: g.ExitStatus(5), Stderr: "Device cryptroot is busy.\n"})
+		r.On("/usr/bin/cryptsetup --tries=1", runnertest.Result{Err: g.ExitStatus(2)})
+
+		cd := g.Cryptdevice{Name: "cryptroot", Format: g.LUKS2}
+
+		if err := cd.Suspend(); !errors.Is(err, g.ErrDeviceBusy) {
+			t.Errorf("unexpected error: %#v", err)
+		} else if !strings.HasSuffix(err.Error(), "Device cryptroot is busy.") {
+			t.Errorf("stderr missing from %#v", err.Error())
+		}
+
+		if err := cd.Resume(strings.NewReader("hunter2\n")); !errors.Is(err, g.ErrWrongPassphrase) {
+			t.Errorf("unexpected error: %#v", err)
+		}
+
+		if err := g.Systemctl("start", "systemd-udevd.service"); err != nil {
+			t.Errorf("unexpected error: %#v", err)
+		}
+
+		expected := []string{
+			"/usr/bin/cryptsetup luksSuspend cryptroot",
+			"/usr/bin/cryptsetup --tries=1 --type luks2 luksResume cryptroot",
+			"/usr/bin/systemctl start systemd-udevd.service",
+		}
+		if got := r.Transcript(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%#v != %#v", got, expected)
+		}
+	})
+}
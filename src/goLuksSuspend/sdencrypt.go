@@ -0,0 +1,213 @@
+package goLuksSuspend
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+//
+// systemd-cryptsetup-generator(8) and the sd-encrypt mkinitcpio hook
+//
+
+// This is a variable to facilitate testing.
+var initramfsCrypttab = "/etc/crypttab.initramfs"
+
+type sdEncryptDevice struct {
+	uuid    string
+	name    string
+	key     Keyfile
+	options string
+}
+
+type sdEncryptParams struct {
+	enabled  bool
+	crypttab bool
+	devices  []sdEncryptDevice
+	// Keys and options without a UUID apply to all devices without one
+	key     Keyfile
+	options string
+}
+
+func newSDEncryptParams() sdEncryptParams {
+	return sdEncryptParams{enabled: true, crypttab: true}
+}
+
+func normalizeUUID(uuid string) string {
+	return strings.ToLower(strings.TrimPrefix(uuid, "luks-"))
+}
+
+func (p *sdEncryptParams) device(uuid string) *sdEncryptDevice {
+	uuid = normalizeUUID(uuid)
+	for i := range p.devices {
+		if p.devices[i].uuid == uuid {
+			return &p.devices[i]
+		}
+	}
+	p.devices = append(p.devices, sdEncryptDevice{uuid: uuid})
+	return &p.devices[len(p.devices)-1]
+}
+
+// parseSDKeyfile parses KEYFILE[:KEYDEV]
+func parseSDKeyfile(s string) Keyfile {
+	fields := strings.SplitN(s, ":", 2)
+	if len(fields) == 2 && len(fields[1]) > 0 {
+		return Keyfile{Path: fields[0], Device: resolveDevice(fields[1]), FSType: "auto"}
+	}
+	return Keyfile{Path: fields[0]}
+}
+
+func parseBool(s string) bool {
+	switch strings.ToLower(s) {
+	case "0", "no", "n", "false", "f", "off":
+		return false
+	default:
+		return true
+	}
+}
+
+// parse consumes a single kernel parameter. Parameters unrelated to
+// sd-encrypt are ignored.
+func (p *sdEncryptParams) parse(key, value string) {
+	switch key {
+	case "rd.luks":
+		p.enabled = parseBool(value)
+	case "rd.luks.crypttab":
+		p.crypttab = parseBool(value)
+	case "rd.luks.uuid":
+		// rd.luks.uuid=UUID
+		p.device(value)
+	case "rd.luks.name":
+		// rd.luks.name=UUID=NAME
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) < 2 || len(kv[1]) == 0 {
+			return
+		}
+		p.device(kv[0]).name = kv[1]
+	case "rd.luks.key":
+		// rd.luks.key=KEYFILE[:KEYDEV] or rd.luks.key=UUID=KEYFILE[:KEYDEV]
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) == 2 && isUUID(normalizeUUID(kv[0])) {
+			p.device(kv[0]).key = parseSDKeyfile(kv[1])
+		} else {
+			p.key = parseSDKeyfile(value)
+		}
+	case "rd.luks.options":
+		// rd.luks.options=OPTIONS or rd.luks.options=UUID=OPTIONS
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) == 2 && isUUID(normalizeUUID(kv[0])) {
+			p.device(kv[0]).options = kv[1]
+		} else {
+			p.options = value
+		}
+	}
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// addCrypttab adds the entries of /etc/crypttab.initramfs, which the
+// sd-encrypt hook installs as /etc/crypttab in the initramfs. Devices
+// already specified on the kernel command line keep their parameters.
+func (p *sdEncryptParams) addCrypttab(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	s := bufio.NewScanner(file)
+
+	for s.Scan() {
+		line := s.Bytes()
+		if ignoreLinePattern.Match(line) {
+			continue
+		}
+
+		fields := strings.Fields(string(line))
+		if len(fields) < 2 {
+			continue
+		}
+
+		_, key := parseCrypttabEntry(string(line))
+		uuid := ""
+		if kv := strings.SplitN(fields[1], "=", 2); len(kv) == 2 && kv[0] == "UUID" {
+			uuid = normalizeUUID(kv[1])
+		}
+
+		var dev *sdEncryptDevice
+		for i := range p.devices {
+			if (len(uuid) > 0 && p.devices[i].uuid == uuid) || p.devices[i].name == fields[0] {
+				dev = &p.devices[i]
+				break
+			}
+		}
+
+		if dev == nil {
+			p.devices = append(p.devices, sdEncryptDevice{uuid: uuid, name: fields[0], key: key})
+			continue
+		}
+
+		if len(dev.name) == 0 {
+			dev.name = fields[0]
+		}
+		if !dev.key.Defined() {
+			dev.key = key
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		_ = file.Close() // errcheck: secondary error
+		return err
+	}
+
+	return file.Close()
+}
+
+// resolve fills in the default names, keys, and options and returns the
+// devices that are unlocked in the initramfs.
+func (p *sdEncryptParams) resolve() []sdEncryptDevice {
+	if !p.enabled {
+		return nil
+	}
+
+	devs := make([]sdEncryptDevice, 0, len(p.devices))
+
+	for _, d := range p.devices {
+		if len(d.name) == 0 {
+			if len(d.uuid) == 0 {
+				continue
+			}
+			d.name = "luks-" + d.uuid
+		}
+		if !d.key.Defined() {
+			d.key = p.key
+		}
+		if len(d.options) == 0 {
+			d.options = p.options
+		}
+		if d.key.Defined() && len(d.options) > 0 {
+			d.key.parseOptions(d.options)
+		}
+		devs = append(devs, d)
+	}
+
+	return devs
+}
@@ -0,0 +1,547 @@
+package goLuksSuspend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+//
+// Simulation
+//
+// With -simulate FILE, the cryptdevices described in FILE are written to
+// a temporary system root with the sysfs, /etc/crypttab, and
+// /etc/crypttab.initramfs entries of real ones, which becomes Root. A
+// Runner prints every program that would be run instead of running it,
+// except cryptsetup, which it emulates on the simulated cryptdevices:
+// luksSuspend and luksClose update the system root, and luksResume checks
+// passphrases, so that failure paths can be exercised too. Other
+// operations that would change the system (mounting, writing to sysfs) are
+// printed instead of performed.
+//
+// Example FILE:
+//
+//	{
+//	  "devices": [
+//	    {"name": "cryptroot", "format": "luks2", "boot": true, "passphrase": "hunter2"},
+//	    {"name": "cryptdata", "format": "luks1", "dependsOn": ["cryptroot"], "keyfile": "/root/data.key"},
+//	    {"name": "cryptswap", "format": "luks2", "failSuspend": true},
+//	    {"name": "cryptbackup", "format": "luks2", "policy": "close-if-unused"}
+//	  ],
+//	  "filesystems": [
+//	    {"mountpoint": "/", "type": "ext4", "devices": ["cryptroot"]},
+//	    {"mountpoint": "/data", "type": "btrfs", "devices": ["cryptdata"], "failFreeze": false}
+//	  ],
+//	  "swaps": [
+//	    {"path": "/dev/mapper/cryptswap", "type": "partition", "devices": ["cryptswap"]}
+//	  ],
+//	  "failSleep": false
+//	}
+//
+
+type SimulatedDevice struct {
+	Name      string   `json:"name"`
+	Format    string   `json:"format"`
+	Boot      bool     `json:"boot"`
+	DependsOn []string `json:"dependsOn"`
+	// Any passphrase is accepted if empty
+	Passphrase string   `json:"passphrase"`
+	Keyfile    string   `json:"keyfile"`
+	Unlock     []string `json:"unlock"`
+	// luksSuspend fails as if the device were busy
+	FailSuspend bool `json:"failSuspend"`
+	// See DevicePolicy
+	Policy string `json:"policy"`
+}
+
+type SimulatedFilesystem struct {
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+	// Names of the simulated devices the filesystem is built upon
+	Devices []string `json:"devices"`
+	// FIFREEZE fails
+	FailFreeze bool `json:"failFreeze"`
+}
+
+type SimulatedSwap struct {
+	Path string `json:"path"`
+	// "partition" or "file"; partition if empty
+	Type string `json:"type"`
+	// Names of the simulated devices the swap area is built upon
+	Devices []string `json:"devices"`
+}
+
+type Simulation struct {
+	Devices     []SimulatedDevice     `json:"devices"`
+	Filesystems []SimulatedFilesystem `json:"filesystems"`
+	Swaps       []SimulatedSwap       `json:"swaps"`
+	// Suspend to RAM fails
+	FailSleep bool `json:"failSleep"`
+
+	path string
+	// The system root in which the simulated cryptdevices are found
+	root  string
+	mutex sync.Mutex
+}
+
+// SimulateMode is true when running with -simulate.
+var SimulateMode = false
+
+var simulation *Simulation
+
+func loadSimulation(path string) error {
+	// The initramfs program is run from /
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	s := &Simulation{path: path}
+	if err := json.Unmarshal(buf, s); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	for i := range s.Devices {
+		switch s.Devices[i].Format {
+		case "", LUKS1.String(), LUKS2.String():
+		default:
+			return fmt.Errorf("%s: %s: unknown format %#v", path, s.Devices[i].Name, s.Devices[i].Format)
+		}
+		if _, err := parseUnlockerNames(strings.Join(s.Devices[i].Unlock, ":")); err != nil {
+			return fmt.Errorf("%s: %s: %s", path, s.Devices[i].Name, err.Error())
+		}
+		if p := s.Devices[i].Policy; len(p) > 0 {
+			if _, err := parseDevicePolicy(p); err != nil {
+				return fmt.Errorf("%s: %s: %s", path, s.Devices[i].Name, err.Error())
+			}
+		}
+	}
+
+	if err := s.install(); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	return nil
+}
+
+// install writes the system root of s to a temporary directory, and
+// installs it as Root, and s as the Runner and System.
+func (s *Simulation) install() error {
+	dir, err := ioutil.TempDir("", "go-luks-suspend-simulate")
+	if err != nil {
+		return err
+	}
+
+	if err := s.writeRoot(dir); err != nil {
+		_ = os.RemoveAll(dir) // errcheck: rm -rf
+		return err
+	}
+
+	s.root = dir
+	simulation = s
+	SimulateMode = true
+	Root = dir
+	SetRunner(s)
+	SetSystem(s)
+
+	return nil
+}
+
+// EndSimulation removes the simulated system root. It does nothing unless
+// simulating.
+func EndSimulation() {
+	if simulation != nil {
+		_ = os.RemoveAll(simulation.root) // errcheck: rm -rf
+	}
+}
+
+// writeRoot writes the sysfs entries of the simulated cryptdevices, and
+// the crypttab entries that describe their keyfiles, unlockers, and
+// policies, below dir. Boot devices are listed in /etc/crypttab.initramfs,
+// from which the kernel command line of the sd-encrypt hook is completed.
+func (s *Simulation) writeRoot(dir string) error {
+	index := make(map[string]int, len(s.Devices))
+	for i := range s.Devices {
+		if _, ok := index[s.Devices[i].Name]; ok {
+			return fmt.Errorf("duplicate cryptdevice: %#v", s.Devices[i].Name)
+		}
+		index[s.Devices[i].Name] = i
+	}
+
+	files := map[string]string{
+		kernelCmdline:     "\n",
+		freezeTimeoutPath: "20000\n",
+	}
+	links := map[string]string{}
+	tab, initramfsTab := "", ""
+
+	for i, d := range s.Devices {
+		block := simulatedBlockName(i)
+		sysdir := filepath.Join("/sys/block", block)
+
+		format := d.Format
+		if len(format) == 0 {
+			format = LUKS2.String()
+		}
+
+		files[filepath.Join(sysdir, "dev")] = fmt.Sprintf("254:%d\n", i)
+		files[filepath.Join(sysdir, "dm", "name")] = d.Name + "\n"
+		files[filepath.Join(sysdir, "dm", "uuid")] = fmt.Sprintf("%s%s-simulated-%s\n", dmUUIDPrefix, strings.ToUpper(format), d.Name)
+		files[filepath.Join(sysdir, "dm", "suspended")] = "0\n"
+		links[filepath.Join(sysClassBlock, block)] = "../../block/" + block
+
+		for _, name := range d.DependsOn {
+			j, ok := index[name]
+			if !ok {
+				return fmt.Errorf("%s: unknown cryptdevice %#v in dependsOn", d.Name, name)
+			}
+			links[filepath.Join(sysdir, "slaves", simulatedBlockName(j))] = "../../" + simulatedBlockName(j)
+			links[filepath.Join("/sys/block", simulatedBlockName(j), "holders", block)] = "../../" + block
+		}
+
+		key := "none"
+		if len(d.Keyfile) > 0 {
+			key = d.Keyfile
+			// Keyfiles are checked for existence on this system
+			if _, err := os.Stat(d.Keyfile); err == nil {
+				files[d.Keyfile] = ""
+			}
+		}
+
+		opts := []string{"luks"}
+		if len(d.Unlock) > 0 {
+			opts = append(opts, "x-go-luks-suspend.unlock="+strings.Join(d.Unlock, ":"))
+		}
+		if len(d.Policy) > 0 {
+			opts = append(opts, "x-go-luks-suspend.policy="+d.Policy)
+		}
+
+		device := "/dev/simulated/" + d.Name
+		if d.Boot {
+			initramfsTab += strings.Join([]string{d.Name, device, key, "luks"}, " ") + "\n"
+			key = "none"
+		}
+		tab += strings.Join([]string{d.Name, device, key, strings.Join(opts, ",")}, " ") + "\n"
+	}
+
+	files["/etc/crypttab"] = tab
+	files[initramfsCrypttab] = initramfsTab
+
+	for path, data := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			return err
+		}
+	}
+
+	for path, target := range links {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(target, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SimulationPath returns the path of the simulation file.
+func SimulationPath() string {
+	if simulation == nil {
+		return ""
+	}
+	return simulation.path
+}
+
+// Plan prints an action that is simulated instead of performed.
+func Plan(action string) {
+	log.Println("[simulate] " + action)
+}
+
+// device returns the simulated cryptdevice called name and its index, or
+// nil and -1 if it does not exist or has been closed.
+func (s *Simulation) device(name string) (*SimulatedDevice, int) {
+	for i := range s.Devices {
+		if s.Devices[i].Name == name && !s.isClosed(i) {
+			return &s.Devices[i], i
+		}
+	}
+	return nil, -1
+}
+
+func (s *Simulation) dmPath(i int, file string) string {
+	return filepath.Join(s.root, "sys/block", simulatedBlockName(i), "dm", file)
+}
+
+func (s *Simulation) isSuspended(i int) bool {
+	buf, err := ioutil.ReadFile(s.dmPath(i, "suspended"))
+	return err == nil && len(buf) > 0 && buf[0] == '1'
+}
+
+func (s *Simulation) setSuspended(i int, suspended bool) error {
+	buf := []byte("0\n")
+	if suspended {
+		buf[0] = '1'
+	}
+	return ioutil.WriteFile(s.dmPath(i, "suspended"), buf, 0644)
+}
+
+func (s *Simulation) isClosed(i int) bool {
+	_, err := os.Stat(s.dmPath(i, ""))
+	return err != nil
+}
+
+// setClosed removes the sysfs entries of the simulated cryptdevice i, and
+// its entries in the holders of the devices it is built upon.
+func (s *Simulation) setClosed(i int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	block := simulatedBlockName(i)
+	paths := []string{
+		filepath.Join(s.root, "sys/block", block),
+		filepath.Join(s.root, sysClassBlock, block),
+	}
+	for _, name := range s.Devices[i].DependsOn {
+		if _, j := s.device(name); j >= 0 {
+			paths = append(paths, filepath.Join(s.root, "sys/block", simulatedBlockName(j), "holders", block))
+		}
+	}
+
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func simulatedBlockName(i int) string {
+	return "dm-" + fmt.Sprint(i)
+}
+
+// dependents returns the simulated filesystems and swap areas on
+// cryptdevs. Those on closed devices are gone.
+func (s *Simulation) dependents(cryptdevs []Cryptdevice) []Dependent {
+	deps := []Dependent{}
+
+	on := func(devices []string) []string {
+		for _, name := range devices {
+			if d, _ := s.device(name); d == nil {
+				return nil
+			}
+		}
+		names := []string{}
+		for i := range cryptdevs {
+			if contains(devices, cryptdevs[i].Name) {
+				names = append(names, cryptdevs[i].Name)
+			}
+		}
+		return names
+	}
+
+	for _, fs := range s.Filesystems {
+		if names := on(fs.Devices); len(names) > 0 {
+			deps = append(deps, Dependent{
+				Kind:         DependentFilesystem,
+				Path:         fs.Mountpoint,
+				Type:         fs.Type,
+				Cryptdevices: names,
+			})
+		}
+	}
+
+	for _, sw := range s.Swaps {
+		typ := sw.Type
+		if len(typ) == 0 {
+			typ = "partition"
+		}
+		if names := on(sw.Devices); len(names) > 0 {
+			deps = append(deps, Dependent{
+				Kind:         DependentSwap,
+				Path:         sw.Path,
+				Type:         typ,
+				Cryptdevices: names,
+			})
+		}
+	}
+
+	return deps
+}
+
+// Run prints the command line of cmd instead of running it. cryptsetup is
+// emulated on the simulated cryptdevices, and fails with its own exit
+// statuses.
+func (s *Simulation) Run(cmd *exec.Cmd) error {
+	Plan("exec: " + strings.Join(cmd.Args, " "))
+
+	if len(cmd.Args) < 3 || cmd.Args[0] != Conf.Cryptsetup {
+		return nil
+	}
+
+	status, msg, err := s.cryptsetup(cmd.Stdin, cmd.Args[1:])
+	if err != nil || status == 0 {
+		return err
+	}
+
+	if cmd.Stderr != nil {
+		if _, err := io.WriteString(cmd.Stderr, msg+"\n"); err != nil {
+			return err
+		}
+	}
+
+	return ExitStatus(status)
+}
+
+// cryptsetup emulates cryptsetup with args, and returns its exit status and
+// error message. See the RETURN CODES section of cryptsetup(8).
+func (s *Simulation) cryptsetup(stdin io.Reader, args []string) (status int, msg string, err error) {
+	action, name := args[len(args)-2], args[len(args)-1]
+
+	d, i := s.device(name)
+	if d == nil {
+		return 4, "Device " + name + " not found (simulated failure).", nil
+	}
+
+	switch action {
+	case "luksSuspend":
+		if d.FailSuspend {
+			return 5, "Device " + name + " is busy (simulated failure).", nil
+		}
+		return 0, "", s.setSuspended(i, true)
+	case "luksClose":
+		if s.isSuspended(i) {
+			return 5, "Device " + name + " is still in use (simulated failure).", nil
+		}
+		return 0, "", s.setClosed(i)
+	case "luksResume":
+		if !contains(args, "--key-file") && len(d.Passphrase) > 0 {
+			buf := []byte{}
+			if stdin != nil {
+				if buf, err = ioutil.ReadAll(stdin); err != nil {
+					return 0, "", err
+				}
+			}
+			if string(bytes.TrimSuffix(buf, []byte{'\n'})) != d.Passphrase {
+				return 2, "No key available with this passphrase (simulated failure).", nil
+			}
+		}
+		return 0, "", s.setSuspended(i, false)
+	}
+
+	return 0, "", nil
+}
+
+// ApplySimulatedEvents updates the state of simulated cryptdevices with
+// events reported by another process. It does nothing unless simulating.
+func ApplySimulatedEvents(events []Event) {
+	if simulation == nil {
+		return
+	}
+
+	for _, e := range events {
+		_, i := simulation.device(e.Device)
+		if i < 0 {
+			continue
+		}
+
+		var err error
+		switch e.Kind {
+		case EventSuspended:
+			err = simulation.setSuspended(i, true)
+		case EventResumed:
+			err = simulation.setSuspended(i, false)
+		}
+		if err != nil {
+			Warn(err.Error())
+		}
+	}
+}
+
+//
+// The simulated System prints the changes it would make instead of making
+// them, and fails where the simulation file says so.
+//
+
+func (s *Simulation) Mount(source, target, fstype string, flags uintptr, data string) error {
+	Plan(fmt.Sprintf("mount source=%#v target=%#v fstype=%#v flags=%#x data=%#v", source, target, fstype, flags, data))
+	return nil
+}
+
+func (s *Simulation) Unmount(target string, flags int) error {
+	Plan(fmt.Sprintf("umount %s", target))
+	return nil
+}
+
+func (s *Simulation) Swapoff(path string) error {
+	Plan("swapoff " + path)
+	return nil
+}
+
+func (s *Simulation) Mkdir(path string, perm os.FileMode) error {
+	Plan(fmt.Sprintf("mkdir -m %o %s", perm, path))
+	return nil
+}
+
+func (s *Simulation) Remove(path string) error {
+	Plan("rm " + path)
+	return nil
+}
+
+func (s *Simulation) WriteSysfile(path string, buf []byte, perm os.FileMode) error {
+	Plan(fmt.Sprintf("write %#v to %s", string(buf), path))
+	if s.FailSleep && path == powerStatePath {
+		return errors.New("write " + path + ": simulated failure")
+	}
+	return nil
+}
+
+func (s *Simulation) Ioctl(mountpoint, op string, req uintptr) error {
+	Plan("ioctl " + op + " " + mountpoint)
+	if op != "FIFREEZE" {
+		return nil
+	}
+	for _, fs := range s.Filesystems {
+		if fs.Mountpoint == mountpoint && fs.FailFreeze {
+			return &os.PathError{Op: op, Path: mountpoint, Err: syscall.EBUSY}
+		}
+	}
+	return nil
+}
+
+func (s *Simulation) SendJournal(fields map[string]string) error {
+	Plan("journal: " + fields["MESSAGE"])
+	return nil
+}
+
+func (s *Simulation) Dependents(cryptdevs []Cryptdevice) ([]Dependent, error) {
+	return s.dependents(cryptdevs), nil
+}
+
+// Shutdown ends the simulation, and exits.
+func (s *Simulation) Shutdown(a Action) {
+	Plan(string(a))
+	EndSimulation()
+	os.Exit(1)
+}
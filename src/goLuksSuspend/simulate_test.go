@@ -0,0 +1,109 @@
+package goLuksSuspend
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// simulate installs s for the duration of f.
+func simulate(t *testing.T, s *Simulation, f func()) {
+	rootSave, runnerSave, systemSave := Root, runner, system
+	defer func() {
+		EndSimulation()
+		Root, simulation, SimulateMode = rootSave, nil, false
+		SetRunner(runnerSave)
+		SetSystem(systemSave)
+	}()
+
+	if err := s.install(); err != nil {
+		t.Fatal(err)
+	}
+
+	f()
+}
+
+func TestSimulation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-luks-suspend-simulation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir) // errcheck: rm -rf
+	}()
+
+	path := filepath.Join(dir, "simulation.json")
+	spec := `{"devices": [
+		{"name": "cryptroot", "format": "luks2", "boot": true, "passphrase": "hunter2"},
+		{"name": "cryptdata", "format": "luks1", "dependsOn": ["cryptroot"], "keyfile": "/data.key"},
+		{"name": "cryptswap", "failSuspend": true}
+	], "filesystems": [
+		{"mountpoint": "/data", "type": "btrfs", "devices": ["cryptdata"], "failFreeze": true}
+	], "swaps": [
+		{"path": "/dev/mapper/cryptswap", "devices": ["cryptswap"]}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(spec), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rootSave, runnerSave, systemSave := Root, runner, system
+	defer func() {
+		EndSimulation()
+		Root, simulation, SimulateMode = rootSave, nil, false
+		SetRunner(runnerSave)
+		SetSystem(systemSave)
+	}()
+
+	if err := loadSimulation(path); err != nil {
+		t.Fatal(err)
+	}
+
+	cryptdevs, cdmap, err := GetCryptdevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cryptdevs) != 3 || cdmap["cryptdata"].Format != LUKS1 || !reflect.DeepEqual(cdmap["cryptdata"].DependsOn, []string{"cryptroot"}) {
+		t.Fatalf("unexpected cryptdevices: %#v", cryptdevs)
+	}
+	if err := AddKeyfilesFromCrypttab(cdmap); err != nil || !cdmap["cryptdata"].Keyfile.Defined() {
+		t.Errorf("keyfile of cryptdata not found: %#v", err)
+	}
+
+	root := cdmap["cryptroot"]
+	if err := root.Verify(); err != nil {
+		t.Error(err)
+	}
+	if err := root.Suspend(); err != nil || !root.Suspended() {
+		t.Errorf("%s not suspended: %#v", root.Name, err)
+	}
+	if err := root.Resume(strings.NewReader("wrong\n")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("unexpected error: %#v", err)
+	}
+	if err := root.Resume(strings.NewReader("hunter2\n")); err != nil || root.Suspended() {
+		t.Errorf("%s not resumed: %#v", root.Name, err)
+	}
+
+	if err := cdmap["cryptswap"].Suspend(); !errors.Is(err, ErrDeviceBusy) {
+		t.Errorf("unexpected error: %#v", err)
+	}
+
+	deps, err := ResolveDependents(cryptdevs)
+	if err != nil || len(deps) != 2 || deps[0].Type != "btrfs" || deps[1].Kind != DependentSwap {
+		t.Errorf("unexpected dependents: %#v %#v", deps, err)
+	}
+	if err := QuiesceFilesystem("/data", "btrfs"); err != nil {
+		t.Error(err)
+	}
+	if err := FreezeFilesystem("/data"); !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("unexpected error: %#v", err)
+	}
+
+	ApplySimulatedEvents([]Event{{Kind: EventSuspended, Device: "cryptdata"}})
+	if !cdmap["cryptdata"].Suspended() {
+		t.Errorf("cryptdata not suspended")
+	}
+}
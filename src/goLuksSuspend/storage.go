@@ -0,0 +1,205 @@
+package goLuksSuspend
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/guns/golibs/errutil"
+)
+
+//
+// Storage on cryptdevices
+//
+// Filesystems and swap areas become inaccessible when a cryptdevice they
+// are built upon is suspended, whether directly or through device-mapper
+// (LVM, dm-integrity), md, partitions, or loop devices.
+//
+
+// A DependentKind tells filesystems and swap areas apart.
+type DependentKind string
+
+const (
+	DependentFilesystem DependentKind = "filesystem"
+	DependentSwap       DependentKind = "swap"
+)
+
+// A Dependent is a filesystem or swap area built upon cryptdevices.
+type Dependent struct {
+	Kind DependentKind
+	// Mountpoint of a filesystem, or path of a swap area
+	Path string
+	// Filesystem type, or "partition" or "file" for swap areas
+	Type string
+	// Kernel name of the block device, followed by those it is built upon
+	Stack []string
+	// Names of the cryptdevices in Stack
+	Cryptdevices []string
+}
+
+// A Swap is an active swap area of /proc/swaps.
+type Swap struct {
+	Path string
+	// "partition" or "file"
+	Type string
+}
+
+// ReadSwaps returns the active swap areas.
+func ReadSwaps() ([]Swap, error) {
+	file, err := os.Open(RootPath("/proc/swaps"))
+	if err != nil {
+		return nil, err
+	}
+
+	swaps := []Swap{}
+	s := bufio.NewScanner(file)
+
+	// Skip the header
+	s.Scan()
+
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			Warn("[WARNING] malformed entry in /proc/swaps: " + s.Text())
+			continue
+		}
+		swaps = append(swaps, Swap{Path: unescapeMountField(fields[0]), Type: fields[1]})
+	}
+
+	if err := errutil.First(s.Err(), file.Close()); err != nil {
+		return nil, err
+	}
+
+	return swaps, nil
+}
+
+// ResolveDependents returns the mounted filesystems and active swap areas
+// that are built upon cryptdevs. Every mount of a filesystem is returned,
+// except those that are mounted over and cannot be reached.
+func ResolveDependents(cryptdevs []Cryptdevice) ([]Dependent, error) {
+	return system.Dependents(cryptdevs)
+}
+
+func (LinuxSystem) Dependents(cryptdevs []Cryptdevice) ([]Dependent, error) {
+	mounts, err := ReadMountinfo()
+	if err != nil {
+		return nil, err
+	}
+
+	swaps, err := ReadSwaps()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	r := resolver{stacks: map[string][]string{}}
+	deps := []Dependent{}
+	hidden := hiddenMounts(mounts)
+
+	// Stacks of visible mounts, for swap files. Filesystems without block
+	// devices have none.
+	type mountStack struct {
+		mountpoint string
+		stack      []string
+	}
+	visible := []mountStack{}
+
+	for _, m := range mounts {
+		if hidden[m.ID] {
+			continue
+		}
+
+		name, ok := BlockName(m.Dev)
+		if !ok {
+			// e.g. btrfs, whose device numbers are those of subvolumes
+			// instead of block devices
+			if name, ok = DeviceFileBlockName(m.Source); !ok {
+				visible = append(visible, mountStack{m.Mountpoint, nil})
+				continue
+			}
+		}
+
+		stack, err := r.stack(name)
+		if err != nil {
+			return nil, err
+		}
+		visible = append(visible, mountStack{m.Mountpoint, stack})
+
+		if names := CryptdevicesIn(cryptdevs, stack); len(names) > 0 {
+			deps = append(deps, Dependent{
+				Kind:         DependentFilesystem,
+				Path:         m.Mountpoint,
+				Type:         m.FSType,
+				Stack:        stack,
+				Cryptdevices: names,
+			})
+		}
+	}
+
+	for _, sw := range swaps {
+		var stack []string
+
+		if sw.Type == "partition" {
+			name, ok := DeviceFileBlockName(sw.Path)
+			if !ok {
+				Warn("[WARNING] swap partition " + sw.Path + " is not a block device")
+				continue
+			}
+			if stack, err = r.stack(name); err != nil {
+				return nil, err
+			}
+		} else {
+			// The filesystem containing a swap file is the mount with the
+			// longest mountpoint that contains it
+			best := -1
+			for i := range visible {
+				if pathContains(visible[i].mountpoint, sw.Path) &&
+					(best < 0 || len(visible[i].mountpoint) > len(visible[best].mountpoint)) {
+					best = i
+				}
+			}
+			if best < 0 {
+				continue
+			}
+			stack = visible[best].stack
+		}
+
+		if names := CryptdevicesIn(cryptdevs, stack); len(names) > 0 {
+			deps = append(deps, Dependent{
+				Kind:         DependentSwap,
+				Path:         sw.Path,
+				Type:         sw.Type,
+				Stack:        stack,
+				Cryptdevices: names,
+			})
+		}
+	}
+
+	return deps, nil
+}
+
+// resolver memoizes block stacks, which many mounts usually share.
+type resolver struct {
+	stacks map[string][]string
+}
+
+func (r *resolver) stack(name string) ([]string, error) {
+	if stack, ok := r.stacks[name]; ok {
+		return stack, nil
+	}
+
+	stack, err := BlockStack(name)
+	if err != nil {
+		return nil, errors.New(name + ": " + err.Error())
+	}
+	r.stacks[name] = stack
+
+	return stack, nil
+}
+
+// pathContains reports whether path is dir or lies below it.
+func pathContains(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
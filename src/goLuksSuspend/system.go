@@ -0,0 +1,123 @@
+package goLuksSuspend
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// A System changes the state of the running system on behalf of this
+// package, other than by running programs, and finds what is built upon
+// its cryptdevices. A Simulation replaces it when running with -simulate.
+type System interface {
+	Mount(source, target, fstype string, flags uintptr, data string) error
+	Unmount(target string, flags int) error
+	Swapoff(path string) error
+	Mkdir(path string, perm os.FileMode) error
+	Remove(path string) error
+	// WriteSysfile writes buf to the sysfs or procfs file at path
+	WriteSysfile(path string, buf []byte, perm os.FileMode) error
+	// Ioctl issues the ioctl request req, called op, on the filesystem
+	// mounted at mountpoint
+	Ioctl(mountpoint, op string, req uintptr) error
+	// SendJournal writes an entry with fields to the systemd journal
+	SendJournal(fields map[string]string) error
+	// Dependents is ResolveDependents
+	Dependents(cryptdevs []Cryptdevice) ([]Dependent, error)
+	// Shutdown reboots, powers off, or halts, and does not return
+	Shutdown(a Action)
+}
+
+// LinuxSystem is the running Linux system.
+type LinuxSystem struct{}
+
+var system System = LinuxSystem{}
+
+// SetSystem installs s as the System used by this package, and returns the
+// previous one.
+func SetSystem(s System) System {
+	prev := system
+	system = s
+	return prev
+}
+
+// Mount is mount(2).
+func Mount(source, target, fstype string, flags uintptr, data string) error {
+	return system.Mount(source, target, fstype, flags, data)
+}
+
+// Unmount is umount2(2).
+func Unmount(target string, flags int) error {
+	return system.Unmount(target, flags)
+}
+
+// Swapoff is swapoff(2).
+func Swapoff(path string) error {
+	return system.Swapoff(path)
+}
+
+// Mkdir is os.Mkdir.
+func Mkdir(path string, perm os.FileMode) error {
+	return system.Mkdir(path, perm)
+}
+
+// Remove is os.Remove.
+func Remove(path string) error {
+	return system.Remove(path)
+}
+
+func writeSysfile(path string, buf []byte, perm os.FileMode) error {
+	return system.WriteSysfile(path, buf, perm)
+}
+
+func (LinuxSystem) Mount(source, target, fstype string, flags uintptr, data string) error {
+	return syscall.Mount(source, target, fstype, flags, data)
+}
+
+func (LinuxSystem) Unmount(target string, flags int) error {
+	return syscall.Unmount(target, flags)
+}
+
+func (LinuxSystem) Swapoff(path string) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_SWAPOFF, uintptr(unsafe.Pointer(p)), 0, 0); errno != 0 {
+		return &os.PathError{Op: "swapoff", Path: path, Err: errno}
+	}
+
+	return nil
+}
+
+func (LinuxSystem) Mkdir(path string, perm os.FileMode) error {
+	return os.Mkdir(path, perm)
+}
+
+func (LinuxSystem) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (LinuxSystem) WriteSysfile(path string, buf []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(RootPath(path), buf, perm)
+}
+
+// Shutdown acts immediately. Nothing is synced, since the root device may
+// be suspended.
+func (LinuxSystem) Shutdown(a Action) {
+	switch a {
+	case ActionReboot:
+		for {
+			_ = ioutil.WriteFile(RootPath("/proc/sysrq-trigger"), []byte{'b'}, 0600) // errcheck: REBOOTING!
+		}
+	case ActionHalt:
+		for {
+			_ = syscall.Reboot(syscall.LINUX_REBOOT_CMD_HALT) // errcheck: HALTING!
+		}
+	default:
+		for {
+			_ = ioutil.WriteFile(RootPath("/proc/sysrq-trigger"), []byte{'o'}, 0600) // errcheck: POWERING OFF!
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package goLuksSuspend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Unlocker is a method of resuming a suspended cryptdevice.
+type Unlocker interface {
+	// Name identifies the unlocker in configuration and messages.
+	Name() string
+
+	// Available reports whether the unlocker can be attempted on cd.
+	Available(cd *Cryptdevice) bool
+
+	// Prompt returns the text shown to the user before Unlock reads from
+	// stdin, or the empty string if Unlock does not read from stdin.
+	Prompt(cd *Cryptdevice) string
+
+	// Unlock makes a single attempt to resume cd.
+	Unlock(cd *Cryptdevice, stdin io.Reader) error
+}
+
+// A secretUnlocker remembers the secret that last unlocked a device so that
+// other devices sharing it can be unlocked without asking again.
+type secretUnlocker interface {
+	Unlocker
+	UnlockWithSharedSecret(cd *Cryptdevice) error
+	ForgetSecret()
+}
+
+// DefaultUnlockers are used for cryptdevices without configured unlockers.
+var DefaultUnlockers = []string{"keyfile", "passphrase"}
+
+var unlockers = map[string]Unlocker{}
+
+func registerUnlocker(u Unlocker) {
+	unlockers[u.Name()] = u
+}
+
+func init() {
+	registerUnlocker(keyfileUnlocker{})
+	registerUnlocker(&passphraseUnlocker{})
+	registerUnlocker(&yubikeyUnlocker{})
+}
+
+// UnlockerNames returns the names of all supported unlockers.
+func UnlockerNames() []string {
+	names := make([]string, 0, len(unlockers))
+	for name := range unlockers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func parseUnlockerNames(s string) ([]string, error) {
+	names := strings.FieldsFunc(s, func(r rune) bool { return r == ':' || r == ',' })
+	for _, name := range names {
+		if _, ok := unlockers[name]; !ok {
+			return nil, fmt.Errorf("unknown unlocker %#v; supported unlockers: %s",
+				name, strings.Join(UnlockerNames(), ", "))
+		}
+	}
+	return names, nil
+}
+
+// Unlockers returns the unlockers configured for cd in the order in which
+// they should be attempted. At least one interactive unlocker is always
+// included so that the user is never left without a way to unlock cd.
+func (cd *Cryptdevice) Unlockers() []Unlocker {
+	names := cd.UnlockWith
+	if len(names) == 0 {
+		names = DefaultUnlockers
+	}
+
+	us := make([]Unlocker, 0, len(names)+1)
+	interactive := false
+
+	for _, name := range names {
+		u, ok := unlockers[name]
+		if !ok {
+			Warn(fmt.Sprintf("[WARNING] %s: unknown unlocker %#v", cd.Name, name))
+			continue
+		}
+		if len(u.Prompt(cd)) > 0 {
+			interactive = true
+		}
+		us = append(us, u)
+	}
+
+	if !interactive {
+		us = append(us, unlockers["passphrase"])
+	}
+
+	return us
+}
+
+// ResumeWithSharedSecret attempts to resume cd with secrets that unlocked
+// other cryptdevices, and returns the name of the unlocker that succeeded.
+func (cd *Cryptdevice) ResumeWithSharedSecret() (method string, ok bool) {
+	for _, u := range cd.Unlockers() {
+		if su, ok := u.(secretUnlocker); ok && su.UnlockWithSharedSecret(cd) == nil {
+			return u.Name(), true
+		}
+	}
+	return "", false
+}
+
+// ForgetSecrets clears the secrets remembered by all unlockers.
+func ForgetSecrets() {
+	for _, u := range unlockers {
+		if su, ok := u.(secretUnlocker); ok {
+			su.ForgetSecret()
+		}
+	}
+}
+
+func clearbytes(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+// readPassphrase reads a single line from r, including the newline.
+func readPassphrase(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 4096)
+	n := 0
+
+	for n < len(buf) {
+		m, err := r.Read(buf[n : n+1])
+		n += m
+		if m > 0 && buf[n-1] == '\n' {
+			break
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			clearbytes(buf)
+			return nil, err
+		}
+	}
+
+	return buf[:n], nil
+}
+
+//
+// Keyfile
+//
+
+type keyfileUnlocker struct{}
+
+func (keyfileUnlocker) Name() string { return "keyfile" }
+
+func (keyfileUnlocker) Available(cd *Cryptdevice) bool { return cd.Keyfile.Available() }
+
+func (keyfileUnlocker) Prompt(cd *Cryptdevice) string { return "" }
+
+func (keyfileUnlocker) Unlock(cd *Cryptdevice, stdin io.Reader) error {
+	return cd.ResumeWithKeyfile()
+}
+
+//
+// Passphrase
+//
+
+type passphraseUnlocker struct {
+	shared []byte
+}
+
+func (*passphraseUnlocker) Name() string { return "passphrase" }
+
+func (*passphraseUnlocker) Available(cd *Cryptdevice) bool { return true }
+
+func (*passphraseUnlocker) Prompt(cd *Cryptdevice) string {
+	return "Enter passphrase for " + cd.Name + ": "
+}
+
+func (u *passphraseUnlocker) Unlock(cd *Cryptdevice, stdin io.Reader) error {
+	passphrase, err := readPassphrase(stdin)
+	if err != nil {
+		return err
+	}
+
+	if err = cd.Resume(bytes.NewReader(passphrase)); err != nil {
+		clearbytes(passphrase)
+		return err
+	}
+
+	u.ForgetSecret()
+	u.shared = passphrase
+
+	return nil
+}
+
+func (u *passphraseUnlocker) UnlockWithSharedSecret(cd *Cryptdevice) error {
+	if len(u.shared) == 0 {
+		return errNoSharedSecret
+	}
+	fmt.Printf("Attempting to unlock %s with previous passphrase...\n", cd.Name)
+	return cd.Resume(bytes.NewReader(u.shared))
+}
+
+func (u *passphraseUnlocker) ForgetSecret() {
+	clearbytes(u.shared)
+	u.shared = nil
+}
+
+//
+// YubiKey challenge-response
+//
+// Compatible with https://github.com/agherzan/yubikey-full-disk-encryption
+// in two factor mode: the challenge is the SHA-256 digest of the user's
+// passphrase (or the passphrase itself if hashing is disabled), and the LUKS
+// passphrase is the challenge followed by the YubiKey's response.
+//
+
+// ErrNoYubikey is returned when no YubiKey is inserted.
+var ErrNoYubikey = errors.New("no YubiKey inserted")
+
+// YubikeyOptions configure the YubiKey unlocker for a cryptdevice.
+type YubikeyOptions struct {
+	// Slot is the challenge-response slot, 1 or 2. Zero means slot 1.
+	Slot uint8
+	// Hash is "sha256" (the default if empty) or "none".
+	Hash string
+}
+
+func parseYubikeySlot(s string) (uint8, error) {
+	switch s {
+	case "1":
+		return 1, nil
+	case "2":
+		return 2, nil
+	default:
+		return 0, fmt.Errorf("invalid YubiKey slot %#v; expected 1 or 2", s)
+	}
+}
+
+func parseYubikeyHash(s string) (string, error) {
+	switch s {
+	case "sha256", "none":
+		return s, nil
+	default:
+		return "", fmt.Errorf("invalid YubiKey hash %#v; expected sha256 or none", s)
+	}
+}
+
+func (o *YubikeyOptions) slot() uint8 {
+	if o.Slot == 0 {
+		return 1
+	}
+	return o.Slot
+}
+
+func (o *YubikeyOptions) challenge(passphrase []byte) []byte {
+	passphrase = bytes.TrimSuffix(passphrase, []byte{'\n'})
+
+	if o.Hash == "none" {
+		return append([]byte{}, passphrase...)
+	}
+
+	hash := sha256.Sum256(passphrase)
+	challenge := make([]byte, hex.EncodedLen(len(hash)))
+	hex.Encode(challenge, hash[:])
+	clearbytes(hash[:])
+
+	return challenge
+}
+
+type yubikeyUnlocker struct{}
+
+func (*yubikeyUnlocker) Name() string { return "yubikey" }
+
+func (*yubikeyUnlocker) Available(cd *Cryptdevice) bool {
+	_, err := os.Stat(Conf.Ykchalresp)
+	return err == nil
+}
+
+func (*yubikeyUnlocker) Prompt(cd *Cryptdevice) string {
+	return "Enter YubiKey challenge passphrase for " + cd.Name + ": "
+}
+
+func (*yubikeyUnlocker) Unlock(cd *Cryptdevice, stdin io.Reader) error {
+	passphrase, err := readPassphrase(stdin)
+	if err != nil {
+		return err
+	}
+
+	challenge := cd.Yubikey.challenge(passphrase)
+	clearbytes(passphrase)
+	defer clearbytes(challenge)
+
+	response, err := ykchalresp(cd.Yubikey.slot(), challenge)
+	if err == ErrNoYubikey {
+		fmt.Printf("Insert YubiKey to unlock %s...\n", cd.Name)
+		response, err = waitForYubikey(cd.Yubikey.slot(), challenge)
+	}
+	if err != nil {
+		return err
+	}
+	defer clearbytes(response)
+
+	key := make([]byte, 0, len(challenge)+len(response)+1)
+	key = append(append(append(key, challenge...), response...), '\n')
+	defer clearbytes(key)
+
+	return cd.Resume(bytes.NewReader(key))
+}
+
+// ykchalresp returns the response of the YubiKey to challenge, without the
+// trailing newline.
+func ykchalresp(slot uint8, challenge []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(Conf.Ykchalresp, "-"+strconv.Itoa(int(slot)), "-i-")
+	cmd.Stdin = bytes.NewReader(challenge)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := Run(cmd); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if strings.Contains(strings.ToLower(msg), "no yubikey present") {
+			return nil, ErrNoYubikey
+		} else if len(msg) > 0 {
+			return nil, errors.New("ykchalresp: " + msg)
+		}
+		return nil, err
+	}
+
+	response := bytes.TrimSuffix(stdout.Bytes(), []byte{'\n'})
+	if len(response) == 0 {
+		return nil, errors.New("ykchalresp: empty response")
+	}
+
+	return response, nil
+}
+
+// waitForYubikey retries ykchalresp until a YubiKey is inserted or
+// the YubiKey timeout expires.
+func waitForYubikey(slot uint8, challenge []byte) ([]byte, error) {
+	deadline := time.Now().Add(Conf.YubikeyTimeout)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+
+		response, err := ykchalresp(slot, challenge)
+		if err != ErrNoYubikey {
+			return response, err
+		}
+	}
+
+	return nil, ErrNoYubikey
+}
@@ -0,0 +1,83 @@
+package goLuksSuspend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCryptdeviceUnlockers(t *testing.T) {
+	data := []struct {
+		in         string
+		unlockWith []string
+		err        bool
+		expected   []string
+	}{
+		{in: "", expected: []string{"keyfile", "passphrase"}},
+		{in: "yubikey:passphrase", unlockWith: []string{"yubikey", "passphrase"}, expected: []string{"yubikey", "passphrase"}},
+		{in: "keyfile", unlockWith: []string{"keyfile"}, expected: []string{"keyfile", "passphrase"}},
+		{in: "keyfile:yubikey", unlockWith: []string{"keyfile", "yubikey"}, expected: []string{"keyfile", "yubikey"}},
+		{in: "keyfile:fingerprint", err: true},
+	}
+
+	for _, row := range data {
+		names, err := parseUnlockerNames(row.in)
+		if (err != nil) != row.err {
+			t.Errorf("%#v: unexpected error: %#v", row.in, err)
+		}
+		if err != nil {
+			continue
+		}
+		if len(names) > 0 && !reflect.DeepEqual(names, row.unlockWith) {
+			t.Errorf("%#v != %#v", names, row.unlockWith)
+		}
+
+		cd := Cryptdevice{Name: "crypt", UnlockWith: names}
+		us := cd.Unlockers()
+		got := make([]string, len(us))
+		for i := range us {
+			got[i] = us[i].Name()
+		}
+		if !reflect.DeepEqual(got, row.expected) {
+			t.Errorf("%#v != %#v", got, row.expected)
+		}
+	}
+}
+
+func TestYubikeyChallenge(t *testing.T) {
+	data := []struct {
+		opts     YubikeyOptions
+		in       string
+		expected string
+	}{
+		{
+			opts:     YubikeyOptions{},
+			in:       "secret\n",
+			expected: "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b",
+		},
+		{
+			opts:     YubikeyOptions{Slot: 2, Hash: "sha256"},
+			in:       "secret",
+			expected: "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b",
+		},
+		{
+			opts:     YubikeyOptions{Hash: "none"},
+			in:       "secret\n",
+			expected: "secret",
+		},
+	}
+
+	for _, row := range data {
+		if got := string(row.opts.challenge([]byte(row.in))); got != row.expected {
+			t.Errorf("%#v: %#v != %#v", row.in, got, row.expected)
+		}
+	}
+
+	for _, s := range []string{"", "0", "3"} {
+		if _, err := parseYubikeySlot(s); err == nil {
+			t.Errorf("%#v: expected error", s)
+		}
+	}
+	if _, err := parseYubikeyHash("sha1"); err == nil {
+		t.Errorf("sha1: expected error")
+	}
+}
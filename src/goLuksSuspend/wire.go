@@ -0,0 +1,179 @@
+package goLuksSuspend
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//
+// go-luks-suspend → initramfs handoff
+//
+// encoding/gob only transmits exported fields, so cryptdevices are converted
+// to descriptors that spell out everything the initramfs needs to find and
+// verify them. Bump WireVersion whenever Handoff or DeviceDescriptor change
+// incompatibly.
+//
+
+const WireVersion = 3
+
+type Handoff struct {
+	Version int
+	Config  Config
+	Devices []DeviceDescriptor
+}
+
+// A DeviceDescriptor identifies a cryptdevice across the chroot boundary.
+type DeviceDescriptor struct {
+	Name string
+	// device-mapper UUID, e.g. CRYPT-LUKS2-<uuid>-<name>
+	UUID string
+	// /sys/block/dm-N/dm
+	DMDir        string
+	Major, Minor uint32
+	Format       LUKSFormat
+	Integrity    string
+	DependsOn    []string
+	UnlockWith   []string
+	Yubikey      YubikeyOptions
+	Keyfile      Keyfile
+	// Keyfile contents loaded on the running system
+	KeyfileData  []byte
+	IsBootDevice bool
+}
+
+func (cd *Cryptdevice) descriptor() DeviceDescriptor {
+	return DeviceDescriptor{
+		Name:         cd.Name,
+		UUID:         string(cd.uuid),
+		DMDir:        cd.dmdir,
+		Major:        cd.major,
+		Minor:        cd.minor,
+		Format:       cd.Format,
+		Integrity:    cd.Integrity,
+		DependsOn:    cd.DependsOn,
+		UnlockWith:   cd.UnlockWith,
+		Yubikey:      cd.Yubikey,
+		Keyfile:      cd.Keyfile,
+		KeyfileData:  cd.Keyfile.data,
+		IsBootDevice: cd.IsBootDevice,
+	}
+}
+
+func (d *DeviceDescriptor) cryptdevice() Cryptdevice {
+	cd := Cryptdevice{
+		Name:         d.Name,
+		Format:       d.Format,
+		Integrity:    d.Integrity,
+		DependsOn:    d.DependsOn,
+		UnlockWith:   d.UnlockWith,
+		Yubikey:      d.Yubikey,
+		uuid:         []byte(d.UUID),
+		dmdir:        d.DMDir,
+		major:        d.Major,
+		minor:        d.Minor,
+		Keyfile:      d.Keyfile,
+		IsBootDevice: d.IsBootDevice,
+	}
+	cd.Keyfile.data = d.KeyfileData
+	return cd
+}
+
+// EncodeHandoff writes conf and cryptdevs to w.
+func EncodeHandoff(w io.Writer, conf Config, cryptdevs []Cryptdevice) error {
+	h := Handoff{
+		Version: WireVersion,
+		Config:  conf,
+		Devices: make([]DeviceDescriptor, len(cryptdevs)),
+	}
+
+	for i := range cryptdevs {
+		h.Devices[i] = cryptdevs[i].descriptor()
+	}
+
+	return gob.NewEncoder(w).Encode(&h)
+}
+
+// DecodeHandoff reads the configuration and cryptdevices written by
+// EncodeHandoff.
+func DecodeHandoff(r io.Reader) (Config, []Cryptdevice, error) {
+	var h Handoff
+
+	if err := gob.NewDecoder(r).Decode(&h); err != nil {
+		return Config{}, nil, err
+	}
+
+	if h.Version != WireVersion {
+		return Config{}, nil, fmt.Errorf("unsupported handoff version %d; expected %d", h.Version, WireVersion)
+	}
+
+	cryptdevs := make([]Cryptdevice, len(h.Devices))
+	for i := range h.Devices {
+		cryptdevs[i] = h.Devices[i].cryptdevice()
+	}
+
+	return h.Config, cryptdevs, nil
+}
+
+// readDevNumbers reads the major:minor numbers of the block device whose dm
+// directory is dmdir.
+func readDevNumbers(dmdir string) (major, minor uint32, err error) {
+	buf, err := ioutil.ReadFile(RootPath(filepath.Join(filepath.Dir(dmdir), "dev")))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fields := strings.SplitN(string(bytes.TrimSpace(buf)), ":", 2)
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("malformed device number %#v", string(buf))
+	}
+
+	maj, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	min, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uint32(maj), uint32(min), nil
+}
+
+// Verify returns an error unless cd still refers to the device-mapper
+// device it was discovered as.
+func (cd *Cryptdevice) Verify() error {
+	if len(cd.dmdir) == 0 || len(cd.uuid) == 0 {
+		return fmt.Errorf("%s: incomplete device identity", cd.Name)
+	}
+
+	uuid, err := ioutil.ReadFile(RootPath(filepath.Join(cd.dmdir, "uuid")))
+	if err != nil {
+		return fmt.Errorf("%s: %s", cd.Name, err.Error())
+	} else if !bytes.Equal(cd.uuid, bytes.TrimSuffix(uuid, []byte{'\n'})) {
+		return fmt.Errorf("%s: %s now refers to another device", cd.Name, cd.dmdir)
+	}
+
+	name, err := ioutil.ReadFile(RootPath(filepath.Join(cd.dmdir, "name")))
+	if err != nil {
+		return fmt.Errorf("%s: %s", cd.Name, err.Error())
+	} else if string(bytes.TrimSuffix(name, []byte{'\n'})) != cd.Name {
+		return fmt.Errorf("%s: renamed to %s", cd.Name, strings.TrimSpace(string(name)))
+	}
+
+	major, minor, err := readDevNumbers(cd.dmdir)
+	if err != nil {
+		return fmt.Errorf("%s: %s", cd.Name, err.Error())
+	} else if major != cd.major || minor != cd.minor {
+		return fmt.Errorf("%s: device number changed from %d:%d to %d:%d",
+			cd.Name, cd.major, cd.minor, major, minor)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package goLuksSuspend
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+)
+
+func TestHandoffRoundTrip(t *testing.T) {
+	conf := DefaultConfig()
+	conf.UnlockAttempts = 5
+
+	cryptdevs := []Cryptdevice{
+		{
+			Name:         "cryptroot",
+			Format:       LUKS2,
+			Integrity:    "cryptroot_dif",
+			UnlockWith:   []string{"yubikey", "passphrase"},
+			Yubikey:      YubikeyOptions{Slot: 2, Hash: "none"},
+			uuid:         []byte("CRYPT-LUKS2-d55cc35be99b44cebe894c573fccfb0b-cryptroot"),
+			dmdir:        "/sys/block/dm-1/dm",
+			major:        254,
+			minor:        1,
+			Keyfile:      Keyfile{Path: "/root.key", KeySlot: 0x81, data: []byte("secret\n")},
+			IsBootDevice: true,
+		},
+		{
+			Name:      "cryptdata",
+			Format:    LUKS1,
+			DependsOn: []string{"cryptroot"},
+			uuid:      []byte("CRYPT-LUKS1-cd5dd4dc5766493eb3c63d6dfd195082-cryptdata"),
+			dmdir:     "/sys/block/dm-2/dm",
+			major:     254,
+			minor:     2,
+		},
+	}
+
+	buf := bytes.Buffer{}
+	if err := EncodeHandoff(&buf, conf, cryptdevs); err != nil {
+		t.Fatal(err)
+	}
+
+	c, devs, err := DecodeHandoff(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c, conf) {
+		t.Errorf("%#v != %#v", c, conf)
+	}
+	if !reflect.DeepEqual(devs, cryptdevs) {
+		t.Errorf("%#v != %#v", devs, cryptdevs)
+	}
+
+	buf.Reset()
+	if err := gob.NewEncoder(&buf).Encode(&Handoff{Version: WireVersion + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecodeHandoff(&buf); err == nil {
+		t.Errorf("expected error for handoff version %d", WireVersion+1)
+	}
+}
+
+func TestVerifyIncompleteIdentity(t *testing.T) {
+	cd := Cryptdevice{Name: "cryptroot"}
+	if err := cd.Verify(); err == nil {
+		t.Errorf("expected error")
+	}
+}